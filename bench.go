@@ -0,0 +1,174 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+// benchConfig holds the options of -bench mode.
+type benchConfig struct {
+	host    string
+	tls     *tls.Config
+	room    string
+	timeout time.Duration
+	// clients is how many connections place orders at once, each at rate
+	// orders per second until duration is up.
+	clients  int
+	rate     float64
+	duration time.Duration
+	// itemID is the item ordered; empty picks the first one in stock.
+	itemID string
+}
+
+// benchResult is what one bench client saw.
+type benchResult struct {
+	latencies []time.Duration
+	// rejected counts server rejections by reason; failed counts orders
+	// that got no ack at all.
+	rejected   map[string]int
+	failed     int
+	connectErr error
+}
+
+// runBench connects cfg.clients headless clients that each place orders at
+// cfg.rate for cfg.duration, then writes a report to w.
+func runBench(w io.Writer, cfg benchConfig) error {
+	fmt.Fprintf(w, "bench: %d clients × %g orders/s for %s against %s\n", cfg.clients, cfg.rate, cfg.duration, cfg.host)
+	results := make([]benchResult, cfg.clients)
+	start := time.Now()
+	deadline := start.Add(cfg.duration)
+	var wg sync.WaitGroup
+	for i := range results {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = benchClient(cfg, i, deadline)
+		}()
+	}
+	wg.Wait()
+	// Clients stop once their next order would fall after the deadline, but
+	// the run still spans the whole duration.
+	return writeBenchReport(w, results, max(time.Since(start), cfg.duration))
+}
+
+// benchClient places orders on one connection until deadline, paced to
+// cfg.rate.
+func benchClient(cfg benchConfig, n int, deadline time.Time) benchResult {
+	res := benchResult{rejected: map[string]int{}}
+	conn, reader, _, err := dialServer(cfg.host, cfg.tls, cfg.room, cfg.timeout)
+	if err != nil {
+		res.connectErr = err
+		return res
+	}
+	defer conn.Close()
+
+	itemID := cfg.itemID
+	if itemID == "" {
+		menu := fetchMenu(conn, reader)
+		if menu.err != nil {
+			res.connectErr = fmt.Errorf("menu: %w", menu.err)
+			return res
+		}
+		for _, it := range menu.items {
+			if !it.soldOut() {
+				itemID = it.ID
+				break
+			}
+		}
+		if itemID == "" {
+			res.connectErr = errors.New("menu: nothing in stock")
+			return res
+		}
+	}
+
+	ord := order{Name: fmt.Sprintf("bench_%d", n+1), ItemID: itemID, Quantity: 1}
+	interval := time.Duration(float64(time.Second) / cfg.rate)
+	next := time.Now()
+	for next.Before(deadline) {
+		time.Sleep(time.Until(next))
+		sent := time.Now()
+		ack := submitOrder(conn, ord, reader)
+		var r rejection
+		switch {
+		case ack.err == nil:
+			res.latencies = append(res.latencies, time.Since(sent))
+		case errors.As(ack.err, &r):
+			// Group "rate limited, try again in 3s" and the like by reason.
+			reason, _, _ := strings.Cut(string(r), ",")
+			res.rejected[reason]++
+		default:
+			res.failed++
+			// A broken connection fails every later order too.
+			return res
+		}
+		next = next.Add(interval)
+	}
+	return res
+}
+
+// writeBenchReport sums up the clients' results.
+func writeBenchReport(w io.Writer, results []benchResult, elapsed time.Duration) error {
+	var (
+		latencies        []time.Duration
+		rejected, failed int
+		connected        int
+		connectErr       error
+	)
+	reasons := map[string]int{}
+	for _, r := range results {
+		if r.connectErr != nil {
+			connectErr = r.connectErr
+			continue
+		}
+		connected++
+		latencies = append(latencies, r.latencies...)
+		failed += r.failed
+		for reason, n := range r.rejected {
+			reasons[reason] += n
+			rejected += n
+		}
+	}
+	if connected == 0 {
+		return fmt.Errorf("no client connected: %w", connectErr)
+	}
+	ok := len(latencies)
+	sent := ok + rejected + failed
+	fmt.Fprintf(w, "clients:    %d connected, %d failed to connect\n", connected, len(results)-connected)
+	if connectErr != nil {
+		fmt.Fprintf(w, "            last connect error: %v\n", connectErr)
+	}
+	fmt.Fprintf(w, "orders:     %d sent, %d ok, %d rejected, %d failed\n", sent, ok, rejected, failed)
+	errRate := 0.0
+	if sent > 0 {
+		errRate = float64(rejected+failed) / float64(sent) * 100
+	}
+	fmt.Fprintf(w, "error rate: %.1f%%\n", errRate)
+	fmt.Fprintf(w, "throughput: %.1f orders/s ok over %s\n", float64(ok)/elapsed.Seconds(), elapsed.Round(time.Millisecond))
+	if ok > 0 {
+		slices.Sort(latencies)
+		fmt.Fprintf(w, "latency:    p50 %s  p90 %s  p99 %s  max %s\n",
+			percentile(latencies, 50), percentile(latencies, 90), percentile(latencies, 99), latencies[ok-1].Round(10*time.Microsecond))
+	}
+	keys := make([]string, 0, len(reasons))
+	for reason := range reasons {
+		keys = append(keys, reason)
+	}
+	slices.Sort(keys)
+	for _, reason := range keys {
+		fmt.Fprintf(w, "rejected:   %d × %s\n", reasons[reason], reason)
+	}
+	return nil
+}
+
+// percentile returns the p-th percentile of sorted by the nearest-rank method.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)].Round(10 * time.Microsecond)
+}
@@ -2,51 +2,263 @@ package main
 
 import (
 	"bufio"
-
+	"bytes"
+	"cmp"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
+	"io/fs"
+	"log"
+	"math"
 	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
+	"github.com/atotto/clipboard"
+	"github.com/charmbracelet/bubbles/cursor"
+	"github.com/charmbracelet/bubbles/spinner"
+	"github.com/charmbracelet/bubbles/textinput"
+	"github.com/charmbracelet/bubbles/viewport"
 	tea "github.com/charmbracelet/bubbletea"
 	"github.com/charmbracelet/huh"
 	"github.com/charmbracelet/lipgloss"
+	gonanoid "github.com/matoous/go-nanoid/v2"
 )
 
 type menuItem struct {
 	ID    string  `json:"id"`
 	Name  string  `json:"name"`
 	Price float64 `json:"price"`
+	// Stock is the remaining quantity; nil means unlimited.
+	Stock *float64 `json:"stock,omitempty"`
+	// Unit is what the item is sold by, e.g. "kg"; empty or "each" means
+	// whole pieces.
+	Unit string `json:"unit,omitempty"`
+	// Category groups items in the order form; empty means uncategorized.
+	Category string `json:"category,omitempty"`
+	// Modifiers are optional choices such as size or milk.
+	Modifiers []modifierGroup `json:"modifiers,omitempty"`
+	// Description is optional text shown when the item is highlighted.
+	Description string `json:"description,omitempty"`
+}
+
+// modifierGroup is a set of choices for an item. Exactly one choice is taken
+// unless Multi is set, in which case any number may be.
+type modifierGroup struct {
+	Name    string           `json:"name"`
+	Multi   bool             `json:"multi,omitempty"`
+	Choices []modifierChoice `json:"choices"`
+}
+
+// modifierChoice is one option of a modifier group; Price is added to the item's.
+type modifierChoice struct {
+	Name  string  `json:"name"`
+	Price float64 `json:"price,omitempty"`
+}
+
+func (it menuItem) soldOut() bool {
+	return it.Stock != nil && *it.Stock <= 0
+}
+
+// fractional reports whether the item is sold by a measure such as weight,
+// so its quantity need not be a whole number.
+func (it menuItem) fractional() bool {
+	return it.Unit != "" && it.Unit != "each"
+}
+
+// formatQuantity renders a quantity with its unit unless the item is sold in
+// pieces, e.g. "2" or "0.5 kg".
+func formatQuantity(q float64, unit string) string {
+	s := strconv.FormatFloat(q, 'f', -1, 64)
+	if unit != "" && unit != "each" {
+		s += " " + unit
+	}
+	return s
+}
+
+// withModifiers returns the item as ordered with the chosen modifiers: its
+// price includes their deltas and its name lists them, e.g. "Latte (Large, Oat)".
+// Single-choice groups left out take their first choice. Unknown groups or
+// choices, or several choices for a single-choice group, are rejected.
+func (it menuItem) withModifiers(sel map[string][]string) (menuItem, string) {
+	for name := range sel {
+		if !slices.ContainsFunc(it.Modifiers, func(g modifierGroup) bool { return g.Name == name }) {
+			return it, "invalid modifier"
+		}
+	}
+	var picked []string
+	for _, g := range it.Modifiers {
+		names := sel[g.Name]
+		if !g.Multi {
+			if len(names) > 1 {
+				return it, "invalid modifier"
+			}
+			if len(names) == 0 {
+				names = []string{g.Choices[0].Name}
+			}
+		}
+		for _, name := range names {
+			if !slices.ContainsFunc(g.Choices, func(c modifierChoice) bool { return c.Name == name }) {
+				return it, "invalid modifier"
+			}
+		}
+		for _, c := range g.Choices {
+			if slices.Contains(names, c.Name) {
+				it.Price += c.Price
+				picked = append(picked, c.Name)
+			}
+		}
+	}
+	if len(picked) > 0 {
+		it.Name += " (" + strings.Join(picked, ", ") + ")"
+	}
+	return it, ""
 }
 
 // order represents the payload we submit back to the server.
 
 // messages used by Bubble Tea
 type (
-	connectedMsg  struct{ conn net.Conn }
+	connectedMsg struct {
+		conn   net.Conn
+		reader *connReader
+		// id is the connection id from the server's welcome line.
+		id string
+		// replay holds the numbered broadcasts read while catching up,
+		// in sequence order.
+		replay []string
+		// restarted is set when the server's numbering is behind the last
+		// broadcast seen, i.e. it restarted and numbers from 1 again.
+		restarted bool
+	}
 	menuLoadedMsg struct {
 		items []menuItem
 		err   error
 	}
 	orderSubmittedMsg struct {
-		ack   string
-		total float64
-		err   error
+		ack      string
+		subtotal float64
+		tax      float64
+		discount float64
+		tip      float64
+		total    float64
+		orderID  string
+		err      error
 	}
-	broadcastMsg  string
-	statusMsg     string
-	serverLineMsg string
+	broadcastMsg   []string
+	statusMsg      string
+	serverLineMsg  string
+	reconnectMsg   struct{ attempt int }
+	latencyTickMsg struct{}
+	// clearStatusMsg clears the status if it still reads the same.
+	clearStatusMsg string
+	// flashDoneMsg ends the newest order's highlight unless a newer one
+	// has restarted it.
+	flashDoneMsg struct{}
 )
 
 type FormFields struct {
 	name        string
 	itemID      string
 	quantityStr string
+	addMore     bool
 	confirm     bool
+	cart        []orderLine
+	category    string
+	// modSingle and modMulti hold the choices for the chosen item's modifier
+	// groups by index; which one applies depends on the group's Multi flag.
+	modSingle []string
+	modMulti  [][]string
+	// tipChoice is a percentage, tipFlat for a flat amount, or empty for no tip.
+	tipChoice  string
+	tipFlatStr string
+	coupon     string
+	// prefill, if set, seeds the next form with a favorite's values.
+	prefill *favorite
+}
+
+const tipFlat = "flat"
+
+// applyTip copies the chosen tip onto the order.
+func (f *FormFields) applyTip(o *order) {
+	switch f.tipChoice {
+	case "":
+	case tipFlat:
+		o.TipAmount, _ = strconv.ParseFloat(strings.TrimSpace(f.tipFlatStr), 64)
+	default:
+		o.TipPercent, _ = strconv.ParseFloat(f.tipChoice, 64)
+	}
+}
+
+// feedEntry is a broadcast shown in the feed along with when it happened.
+type feedEntry struct {
+	// tag is the broadcast tag, or "" for chat.
+	tag  string
+	text string
+	at   time.Time
+}
+
+// parseBroadcast splits a tagged broadcast line into its tag, timestamp and
+// body. It accepts both "[tag]|<RFC3339>|body" and the older "[tag] body";
+// lines without a usable timestamp are stamped with the time they arrived.
+func parseBroadcast(line string) (tag string, at time.Time, body string) {
+	at = time.Now()
+	if !strings.HasPrefix(line, "[") {
+		return "", at, line
+	}
+	end := strings.Index(line, "]")
+	if end < 0 {
+		return "", at, line
+	}
+	tag, rest := line[1:end], line[end+1:]
+	if after, ok := strings.CutPrefix(rest, "|"); ok {
+		if ts, b, ok := strings.Cut(after, "|"); ok {
+			if t, err := time.Parse(time.RFC3339, ts); err == nil {
+				return tag, t, b
+			}
+		}
+		return tag, at, after
+	}
+	return tag, at, strings.TrimPrefix(rest, " ")
+}
+
+// splitSeq splits the sequence number off a numbered broadcast such as
+// "#42 [order]|...". Lines without one, e.g. from older servers, have seq 0.
+func splitSeq(line string) (seq uint64, rest string) {
+	num, rest, ok := strings.Cut(strings.TrimPrefix(line, "#"), " ")
+	if !ok || !strings.HasPrefix(line, "#") {
+		return 0, line
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return 0, line
+	}
+	return n, rest
+}
+
+// relativeTime renders how long ago t was, e.g. "2m ago".
+func relativeTime(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Minute:
+		return "just now"
+	case d < time.Hour:
+		return fmt.Sprintf("%dm ago", int(d.Minutes()))
+	case d < 24*time.Hour:
+		return fmt.Sprintf("%dh ago", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd ago", int(d.Hours()/24))
+	}
 }
 
 // model holds the TUI state.
@@ -54,12 +266,78 @@ type model struct {
 	host string
 	conn net.Conn
 
-	title      string
-	status     string
-	loading    bool
-	err        error
-	lastOrder  *order
-	broadcasts []string
+	// readOnly shows only the feed, full width, and disables ordering.
+	readOnly bool
+
+	title string
+	// banner is ASCII art shown in place of the title when it fits.
+	banner  string
+	status  string
+	loading bool
+	// refreshingMenu marks a menu fetch from the refresh key, which updates
+	// the menu without opening the order form.
+	refreshingMenu bool
+	err            error
+	// checkingStock marks a menu fetch after the server rejected an order as
+	// sold out, to tell which of its items ran out.
+	checkingStock bool
+	// menuStale is set when the server announces a menu change, and cleared
+	// once the menu is fetched again.
+	menuStale bool
+	// serverError describes the last request the server rejected, e.g.
+	// "Server rejected order: sold out"; err holds transport and client errors.
+	serverError string
+	lastOrder   *order
+	lastOrderID string
+	// retryable is set while lastOrder failed to reach the server, rather
+	// than being rejected, and can be sent again; orderRetries counts how
+	// many times it was.
+	retryable    bool
+	orderRetries int
+	// lastSubtotal, lastTax, lastDiscount and lastTip break down lastTotal as
+	// priced by the server.
+	lastSubtotal float64
+	lastTax      float64
+	lastDiscount float64
+	lastTip      float64
+	lastTotal    float64
+	// lastStatus is the last order's preparation state from [status] broadcasts.
+	lastStatus string
+	// session holds every order accepted since the client started, for the receipt.
+	session []savedOrder
+	// sessionCount and sessionTotal tally the orders accepted since the client
+	// started. Like session, they carry across reconnects.
+	sessionCount int
+	sessionTotal float64
+	// broadcasts and activity keep the newest feedSize entries, oldest first.
+	broadcasts *ring[feedEntry]
+	// activity holds chat and join/leave/rename/pm lines; showActivity
+	// switches the right panel from orders to it.
+	activity     *ring[feedEntry]
+	showActivity bool
+	feed         viewport.Model
+	// spinner animates next to the status while loading is set.
+	spinner spinner.Model
+	// browsing shows the read-only menu browser, scrolled by menuView,
+	// in place of the panels.
+	browsing bool
+	menuView viewport.Model
+	// feedPaused holds new orders in held instead of broadcasts, so the feed
+	// stays still; they are added when it resumes.
+	feedPaused bool
+	held       []feedEntry
+	// flashUntil is when the highlight on the newest order ends.
+	flashUntil time.Time
+	// myName is the customer name last submitted from this client, used to
+	// mark our own orders in the feed.
+	myName string
+	// connID is this connection's server-assigned id. username is the last
+	// name the server confirmed for it, restored with /name on reconnect;
+	// pendingName/nameAttempt track a /name still awaiting confirmation.
+	connID      string
+	username    string
+	pendingName string
+	nameAttempt int
 
 	form        *huh.Form
 	formFields  *FormFields
@@ -72,28 +350,398 @@ type model struct {
 	width  int
 	height int
 
-	reader             *bufio.Reader
+	reader             *connReader
 	broadcastListening bool
 	pauseBroadcast     bool
+
+	reconnecting     bool
+	reconnectAttempt int
+	maxReconnects    int
+	connectTimeout   time.Duration
+
+	tlsConfig   *tls.Config
+	ordersFile  string
+	receiptFile string
+
+	// rtt is the latest PING/PONG round trip; pingSentAt is when the
+	// outstanding probe was sent, or zero if none is pending.
+	rtt        time.Duration
+	pingSentAt time.Time
+
+	// quitting shows the "Really quit?" prompt.
+	quitting bool
+
+	// defaultName pre-fills the name input of a new order.
+	defaultName string
+	keys        keyBindings
+	// room is joined on every connect; chat and orders stay within it.
+	room string
+	// maxQuantity caps the quantity field of the order form; zero means no limit.
+	maxQuantity int
+	// summary is the server's latest [summary] of today's totals.
+	summary string
+	// lastSeq is the sequence number of the newest broadcast seen, asked
+	// for again with REPLAY on reconnect.
+	lastSeq uint64
+	// favorite is the order the quick-order key places; configFile is where
+	// the favorite key saves it. quickOrdering marks a menu fetch for it.
+	favorite      *favorite
+	configFile    string
+	quickOrdering bool
+
+	// orderBar is the one-line "name,itemId,qty" order entry while it is
+	// open; orderBarErr is why its last input was not submitted.
+	orderBar    *textinput.Model
+	orderBarErr string
+	// chatInput is the chat line while chat mode is open; chatErr is why the
+	// last line was not sent or what the server said about it.
+	chatInput *textinput.Model
+	chatErr   string
+
+	// themeMode is "auto", "dark" or "light"; colors is resolved from it and
+	// the dark and light palettes whenever it changes.
+	themeMode string
+	dark      theme
+	light     theme
+	colors    palette
+}
+
+// clientConfig holds the options the TUI client is started with.
+type clientConfig struct {
+	host          string
+	maxReconnects int
+	// connectTimeout bounds each dial to the server.
+	connectTimeout time.Duration
+	// tls enables TLS when non-nil.
+	tls         *tls.Config
+	ordersFile  string
+	receiptFile string
+	name        string
+	room        string
+	maxQuantity int
+	configFile  string
+	favorite    *favorite
+	banner      string
+	// readOnly runs the client as a display: feed only, no ordering.
+	readOnly bool
+	// feedSize is how many entries each feed panel keeps.
+	feedSize  int
+	theme     theme
+	themeMode string
+	keys      keyBindings
+}
+
+// theme holds the TUI colors, as lipgloss colors (ANSI numbers or "#rrggbb").
+type theme struct {
+	Accent string `json:"accent"`
+	OK     string `json:"ok"`
+	Warn   string `json:"warn"`
+	Error  string `json:"error"`
+	Bullet string `json:"bullet"`
+	Name   string `json:"name"`
+	Item   string `json:"item"`
+	Price  string `json:"price"`
+	Border string `json:"border"`
+}
+
+// darkTheme suits dark terminal backgrounds. lightTheme keeps the same hues
+// but darker, so they stay readable on light backgrounds.
+var (
+	darkTheme = theme{
+		Accent: "212",
+		OK:     "10",
+		Warn:   "178",
+		Error:  "9",
+		Bullet: "141",
+		Name:   "86",
+		Item:   "117",
+		Price:  "220",
+		Border: "240",
+	}
+	lightTheme = theme{
+		Accent: "162",
+		OK:     "28",
+		Warn:   "130",
+		Error:  "160",
+		Bullet: "91",
+		Name:   "30",
+		Item:   "25",
+		Price:  "136",
+		Border: "248",
+	}
+)
+
+// themeModes are the accepted -theme values in the order the theme key cycles
+// through them. "auto" follows the terminal background.
+var themeModes = []string{"auto", "dark", "light"}
+
+// palette is a theme resolved to lipgloss colors.
+type palette struct {
+	Accent, OK, Warn, Error, Bullet, Name, Item, Price, Border lipgloss.TerminalColor
+}
+
+// newPalette resolves mode against the dark and light themes. In auto mode
+// every color is adaptive, so lipgloss picks by the terminal background.
+func newPalette(mode string, dark, light theme) palette {
+	pick := func(d, l string) lipgloss.TerminalColor {
+		switch mode {
+		case "dark":
+			return lipgloss.Color(d)
+		case "light":
+			return lipgloss.Color(l)
+		}
+		return lipgloss.AdaptiveColor{Light: l, Dark: d}
+	}
+	return palette{
+		Accent: pick(dark.Accent, light.Accent),
+		OK:     pick(dark.OK, light.OK),
+		Warn:   pick(dark.Warn, light.Warn),
+		Error:  pick(dark.Error, light.Error),
+		Bullet: pick(dark.Bullet, light.Bullet),
+		Name:   pick(dark.Name, light.Name),
+		Item:   pick(dark.Item, light.Item),
+		Price:  pick(dark.Price, light.Price),
+		Border: pick(dark.Border, light.Border),
+	}
+}
+
+// keyBindings are the single keys for the main screen's actions.
+type keyBindings struct {
+	NewOrder        string `json:"newOrder"`
+	Save            string `json:"save"`
+	Reconnect       string `json:"reconnect"`
+	CancelReconnect string `json:"cancelReconnect"`
+	Quit            string `json:"quit"`
+	Activity        string `json:"activity"`
+	ClearFeed       string `json:"clearFeed"`
+	Theme           string `json:"theme"`
+	Receipt         string `json:"receipt"`
+	RefreshMenu     string `json:"refreshMenu"`
+	BrowseMenu      string `json:"browseMenu"`
+	Copy            string `json:"copy"`
+	PauseFeed       string `json:"pauseFeed"`
+	SaveFavorite    string `json:"saveFavorite"`
+	QuickOrder      string `json:"quickOrder"`
+	OrderBar        string `json:"orderBar"`
+	RetryOrder      string `json:"retryOrder"`
+	Chat            string `json:"chat"`
+}
+
+var defaultKeys = keyBindings{NewOrder: "n", Save: "s", Reconnect: "r", CancelReconnect: "x", Quit: "q", Activity: "a", ClearFeed: "c", Theme: "T", Receipt: "e", RefreshMenu: "m", BrowseMenu: "v", Copy: "y", PauseFeed: "p", SaveFavorite: "f", QuickOrder: "o", OrderBar: ":", RetryOrder: "R", Chat: "t"}
+
+// fileConfig is the optional client config file (~/.clink/config.json).
+// Unset fields keep their defaults; command-line flags take precedence.
+type fileConfig struct {
+	Host     string      `json:"host"`
+	Name     string      `json:"name"`
+	Room     string      `json:"room"`
+	Theme    theme       `json:"theme"`
+	Keys     keyBindings `json:"keys"`
+	Favorite *favorite   `json:"favorite,omitempty"`
+
+	// ConnectTimeout is a duration such as "5s".
+	ConnectTimeout string `json:"connectTimeout"`
+}
+
+// favorite is a saved single-item order the quick-order key places as is.
+type favorite struct {
+	Name     string  `json:"name"`
+	ItemID   string  `json:"itemId"`
+	Quantity float64 `json:"quantity"`
+}
+
+// loadFileConfig reads the client config file. A missing file is not an error.
+func loadFileConfig(path string) (fileConfig, error) {
+	var fc fileConfig
+	b, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return fc, nil
+	}
+	if err != nil {
+		return fc, err
+	}
+	if err := json.Unmarshal(b, &fc); err != nil {
+		return fc, fmt.Errorf("parse %s: %w", path, err)
+	}
+	return fc, nil
+}
+
+// orDefault returns v, or def if v is empty.
+func orDefault(v, def string) string {
+	if v == "" {
+		return def
+	}
+	return v
+}
+
+func (t theme) withDefaults(def theme) theme {
+	return theme{
+		Accent: orDefault(t.Accent, def.Accent),
+		OK:     orDefault(t.OK, def.OK),
+		Warn:   orDefault(t.Warn, def.Warn),
+		Error:  orDefault(t.Error, def.Error),
+		Bullet: orDefault(t.Bullet, def.Bullet),
+		Name:   orDefault(t.Name, def.Name),
+		Item:   orDefault(t.Item, def.Item),
+		Price:  orDefault(t.Price, def.Price),
+		Border: orDefault(t.Border, def.Border),
+	}
+}
+
+func (k keyBindings) withDefaults() keyBindings {
+	return keyBindings{
+		NewOrder:        orDefault(k.NewOrder, defaultKeys.NewOrder),
+		Save:            orDefault(k.Save, defaultKeys.Save),
+		Reconnect:       orDefault(k.Reconnect, defaultKeys.Reconnect),
+		CancelReconnect: orDefault(k.CancelReconnect, defaultKeys.CancelReconnect),
+		Quit:            orDefault(k.Quit, defaultKeys.Quit),
+		Activity:        orDefault(k.Activity, defaultKeys.Activity),
+		ClearFeed:       orDefault(k.ClearFeed, defaultKeys.ClearFeed),
+		Theme:           orDefault(k.Theme, defaultKeys.Theme),
+		Receipt:         orDefault(k.Receipt, defaultKeys.Receipt),
+		RefreshMenu:     orDefault(k.RefreshMenu, defaultKeys.RefreshMenu),
+		BrowseMenu:      orDefault(k.BrowseMenu, defaultKeys.BrowseMenu),
+		Copy:            orDefault(k.Copy, defaultKeys.Copy),
+		PauseFeed:       orDefault(k.PauseFeed, defaultKeys.PauseFeed),
+		SaveFavorite:    orDefault(k.SaveFavorite, defaultKeys.SaveFavorite),
+		QuickOrder:      orDefault(k.QuickOrder, defaultKeys.QuickOrder),
+		OrderBar:        orDefault(k.OrderBar, defaultKeys.OrderBar),
+		RetryOrder:      orDefault(k.RetryOrder, defaultKeys.RetryOrder),
+		Chat:            orDefault(k.Chat, defaultKeys.Chat),
+	}
 }
 
 // initialModel creates a base model.
-func initialModel(host string) model {
-	return model{
-		host:       host,
-		title:      "Order Console",
-		formFields: &FormFields{},
+func initialModel(cfg clientConfig) model {
+	m := model{
+		host:          cfg.host,
+		title:         "Order Console",
+		banner:        cfg.banner,
+		formFields:    &FormFields{},
+		feed:          viewport.New(0, 0),
+		menuView:      viewport.New(0, 0),
+		spinner:       spinner.New(spinner.WithSpinner(spinner.Dot)),
+		maxReconnects: cfg.maxReconnects,
+		status:        fmt.Sprintf("Connecting to %s...", cfg.host),
+		tlsConfig:     cfg.tls,
+		ordersFile:    cfg.ordersFile,
+		receiptFile:   cfg.receiptFile,
+		broadcasts:    newRing[feedEntry](cfg.feedSize),
+		activity:      newRing[feedEntry](cfg.feedSize),
+		defaultName:   cfg.name,
+		room:          cfg.room,
+		maxQuantity:   cfg.maxQuantity,
+		configFile:    cfg.configFile,
+		favorite:      cfg.favorite,
+		keys:          cfg.keys.withDefaults(),
+		themeMode:     cfg.themeMode,
+		dark:          cfg.theme.withDefaults(darkTheme),
+		light:         cfg.theme.withDefaults(lightTheme),
+	}
+	m.connectTimeout = cfg.connectTimeout
+	m.readOnly = cfg.readOnly
+	m.colors = newPalette(m.themeMode, m.dark, m.light)
+	return m
+}
+
+// defaultFeedSize is how many orders, and separately activity lines, the
+// feed keeps for scrolling back unless -feed-size says otherwise.
+const defaultFeedSize = 200
+
+// latencyInterval is how often the client probes the server's round-trip time.
+const latencyInterval = 5 * time.Second
+
+func latencyTickCmd() tea.Cmd {
+	return tea.Tick(latencyInterval, func(time.Time) tea.Msg { return latencyTickMsg{} })
+}
+
+// sendLineCmd writes a command whose reply, if any, arrives through the
+// broadcast listener, such as PING or /name.
+func sendLineCmd(conn net.Conn, line string) tea.Cmd {
+	return func() tea.Msg {
+		_, _ = fmt.Fprintln(conn, line)
+		return nil
 	}
 }
 
+// maxNameAttempts bounds how many suffixed names are tried when the wanted
+// username is taken.
+const maxNameAttempts = 5
+
+// requestName asks the server for base as username, or base_<attempt+1> on
+// retries after "username taken".
+func (m *model) requestName(base string, attempt int) tea.Cmd {
+	if base == "" || m.conn == nil {
+		return nil
+	}
+	if attempt >= maxNameAttempts {
+		m.pendingName = ""
+		m.status = fmt.Sprintf("Could not restore username %q: taken", base)
+		return nil
+	}
+	m.pendingName = base
+	m.nameAttempt = attempt
+	name := base
+	if attempt > 0 {
+		name = fmt.Sprintf("%s_%d", base, attempt+1)
+	}
+	return sendLineCmd(m.conn, "/name "+name)
+}
+
+const (
+	reconnectBaseDelay = time.Second
+	reconnectMaxDelay  = 30 * time.Second
+)
+
+// scheduleReconnect queues the next automatic reconnect attempt with
+// exponential backoff, or gives up once maxReconnects is exhausted.
+func (m *model) scheduleReconnect() tea.Cmd {
+	m.reconnectAttempt++
+	if m.reconnectAttempt > m.maxReconnects {
+		m.reconnecting = false
+		m.status = fmt.Sprintf("Gave up reconnecting after %d attempts. Press '%s' to retry.", m.maxReconnects, m.keys.Reconnect)
+		return nil
+	}
+	delay := reconnectBaseDelay << (m.reconnectAttempt - 1)
+	if delay > reconnectMaxDelay || delay <= 0 {
+		delay = reconnectMaxDelay
+	}
+	attempt := m.reconnectAttempt
+	return tea.Tick(delay, func(time.Time) tea.Msg { return reconnectMsg{attempt: attempt} })
+}
+
 func (m model) Init() tea.Cmd {
 	// Connect on startup
-	return connectCmd(m.host)
+	return tea.Batch(connectCmd(m.host, m.tlsConfig, m.room, m.lastSeq, m.connectTimeout), latencyTickCmd())
 }
 
 func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 
+	// While the quit prompt is up, keys answer it and nothing else.
+	if km, ok := msg.(tea.KeyMsg); ok {
+		if m.quitting {
+			switch km.String() {
+			case "y", "Y":
+				if m.conn != nil {
+					_ = m.conn.Close()
+				}
+				return m, tea.Quit
+			case "n", "N", "esc":
+				m.quitting = false
+			}
+			return m, nil
+		}
+		// Ask before abandoning a half-filled form or an order in flight.
+		// Only ctrl+c is taken from the form so q can still be typed into it.
+		switch k := km.String(); {
+		case m.form != nil && k == "ctrl+c",
+			m.form == nil && m.loading && !m.browsing && (k == "ctrl+c" || m.orderBar == nil && m.chatInput == nil && (k == m.keys.Quit || k == "esc")):
+			m.quitting = true
+			return m, nil
+		}
+	}
+
 	// If a form is active, delegate to it first.
 	if m.form != nil {
 		var cmd tea.Cmd
@@ -105,19 +753,26 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 
 		if m.form.State == huh.StateCompleted {
-			// Parse and submit order if confirmed.
-			qty, err := strconv.Atoi(strings.TrimSpace(m.formFields.quantityStr))
-			if err != nil || qty <= 0 {
+			// Add the item to the cart, then either continue or submit if confirmed.
+			qty, err := m.parseQuantity(m.formFields.quantityStr)
+			if err != nil {
 				m.err = fmt.Errorf("invalid quantity: %v", m.formFields.quantityStr)
 				m.form = nil
 				return m, nil
 			}
-			ord := &order{
-				Name:     strings.TrimSpace(m.formFields.name),
-				ItemID:   m.formFields.itemID,
-				Quantity: qty,
+			m.formFields.cart = append(m.formFields.cart, orderLine{ItemID: m.formFields.itemID, Quantity: qty, Modifiers: m.selectedModifiers()})
+			if m.formFields.addMore {
+				m.form = m.nextItemForm()
+				return m, m.form.Init()
 			}
-			m.lastOrder = ord
+			ord := newOrder(strings.TrimSpace(m.formFields.name), m.formFields.cart)
+			m.formFields.applyTip(&ord)
+			ord.Coupon = strings.TrimSpace(m.formFields.coupon)
+			m.lastOrder = &ord
+			m.lastOrderID = ""
+			m.lastStatus = ""
+			m.lastSubtotal, m.lastTax, m.lastDiscount, m.lastTip, m.lastTotal = 0, 0, 0, 0, 0
+			m.retryable = false
 			m.form = nil
 
 			if m.formFields.confirm {
@@ -125,11 +780,8 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					m.status = "Not connected. Unable to submit order."
 					return m, nil
 				}
-				m.err = nil
-				m.loading = true
-				m.pauseBroadcast = true
-				m.status = "Submitting order..."
-				return m, submitOrderCmd(m.conn, *ord, m.reader)
+				m.err, m.serverError = nil, ""
+				return m, m.sendOrder(ord, "Submitting order...")
 			}
 			m.status = "Order canceled."
 			if m.broadcastListening {
@@ -152,34 +804,92 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	switch msg := msg.(type) {
 	case connectedMsg:
+		m.reconnecting = false
+		m.reconnectAttempt = 0
 		m.conn = msg.conn
-		m.reader = bufio.NewReader(m.conn)
+		m.reader = msg.reader
+		m.rtt = 0
+		m.pingSentAt = time.Time{}
+		m.connID = msg.id
 		m.status = fmt.Sprintf("Connected to %s", m.host)
 
-		_ = m.conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
-		for i := 0; i < 2; i++ {
-			if _, err := m.reader.ReadString('\n'); err != nil {
-				break
+		m.broadcastListening = true
+		if msg.restarted {
+			// Numbers seen before the restart would hide the new ones.
+			m.lastSeq = 0
+		}
+		cmds := m.applyBroadcasts(msg.replay)
+		m.refreshFeed()
+		cmds = append(cmds, listenForBroadcastsCmd(m.conn, m.reader))
+		// Restore the previous username, or claim the configured name on first connect.
+		want := m.username
+		if want == "" {
+			want = m.defaultName
+			// The server applies its username rules; say so up front if
+			// they would change the configured name.
+			if clean := sanitizeUsername(want); clean == "" && want != "" {
+				m.status += fmt.Sprintf(". Name %q is not a valid username", want)
+				want = ""
+			} else if clean != want {
+				m.status += fmt.Sprintf(". Username will be %q", clean)
 			}
 		}
-		_ = m.conn.SetReadDeadline(time.Time{})
-
-		m.broadcastListening = true
-		return m, listenForBroadcastsCmd(m.conn, m.reader)
+		m.username = ""
+		if cmd := m.requestName(want, 0); cmd != nil {
+			cmds = append(cmds, cmd)
+		}
+		return m, tea.Batch(cmds...)
 
 	case menuLoadedMsg:
 		m.loading = false
 		m.pauseBroadcast = false
+		refresh, quick, stock := m.refreshingMenu, m.quickOrdering, m.checkingStock
+		m.refreshingMenu, m.quickOrdering, m.checkingStock = false, false, false
 		if msg.err != nil {
-			m.err = msg.err
+			m.setErr("menu request", msg.err)
 			m.status = "Failed to load menu."
 			if m.broadcastListening {
 				return m, listenForBroadcastsCmd(m.conn, m.reader)
 			}
 			return m, nil
 		}
-		m.err = nil
+		m.err, m.serverError = nil, ""
 		m.menu = msg.items
+		m.refreshMenuView()
+		if len(m.menu) == 0 {
+			// A form without items could never be completed.
+			m.status = "Menu is empty, nothing to order."
+			if m.broadcastListening {
+				return m, listenForBroadcastsCmd(m.conn, m.reader)
+			}
+			return m, nil
+		}
+		if quick {
+			// A submitted order resumes the listener once it is answered.
+			cmd := m.quickOrder()
+			if m.form != nil && m.broadcastListening {
+				return m, tea.Batch(cmd, listenForBroadcastsCmd(m.conn, m.reader))
+			}
+			return m, cmd
+		}
+		if stock && m.lastOrder != nil {
+			m.status = "Order submission failed."
+			m.serverError = "Server rejected order: sold out"
+			if short := m.outOfStock(*m.lastOrder); len(short) > 0 {
+				m.serverError = "Server rejected order, stock changed: " + strings.Join(short, ", ")
+			}
+			if m.broadcastListening {
+				return m, listenForBroadcastsCmd(m.conn, m.reader)
+			}
+			return m, nil
+		}
+		if refresh {
+			m.status = fmt.Sprintf("Menu refreshed: %d items.", len(m.menu))
+			if m.broadcastListening {
+				return m, listenForBroadcastsCmd(m.conn, m.reader)
+			}
+			return m, nil
+		}
 		m.status = "Menu loaded."
 
 		m.form = m.buildForm()
@@ -192,16 +902,45 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.loading = false
 		m.pauseBroadcast = false
 		if msg.err != nil {
-			m.err = msg.err
+			m.setErr("order", msg.err)
 			m.status = "Order submission failed."
+			// A rejected order would only be rejected again; one that got
+			// lost on the way can be resent as is.
+			var r rejection
+			if errors.As(msg.err, &r) && r == "sold out" && m.lastOrder != nil && m.conn != nil {
+				// The menu's stock was fetched before the order was placed;
+				// fetch it again to tell which item ran out.
+				m.loading = true
+				m.refreshingMenu = true
+				m.checkingStock = true
+				m.pauseBroadcast = true
+				m.status = "Order submission failed. Checking stock..."
+				return m, tea.Batch(fetchMenuCmd(m.conn, m.reader), m.spinner.Tick)
+			}
+			if !errors.As(msg.err, &r) && m.lastOrder != nil {
+				m.retryable = true
+				m.status = fmt.Sprintf("Order submission failed. Press '%s' to retry it.", m.keys.RetryOrder)
+				if m.orderRetries > 0 {
+					m.status = fmt.Sprintf("Order submission failed (retry %d). Press '%s' to retry it.", m.orderRetries, m.keys.RetryOrder)
+				}
+			}
 			if m.broadcastListening {
 				return m, listenForBroadcastsCmd(m.conn, m.reader)
 			}
 			return m, nil
 		}
-		m.err = nil
+		m.err, m.serverError = nil, ""
+		m.lastOrderID = msg.orderID
+		m.lastStatus = "received"
+		m.lastSubtotal, m.lastTax, m.lastDiscount, m.lastTip, m.lastTotal = msg.subtotal, msg.tax, msg.discount, msg.tip, msg.total
+		m.session = append(m.session, m.receipt())
 		if msg.total > 0 {
+			m.sessionCount++
+			m.sessionTotal += msg.total
 			m.status = fmt.Sprintf("Order submitted. Total: $%.2f", msg.total)
+			if m.orderRetries > 0 {
+				m.status = fmt.Sprintf("Order submitted on retry %d. Total: $%.2f", m.orderRetries, msg.total)
+			}
 
 			if !m.broadcastListening {
 				m.broadcastListening = true
@@ -216,18 +955,44 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		}
 		return m, nil
 
+	case spinner.TickMsg:
+		// Let the tick chain end once nothing is loading.
+		if !m.loading {
+			return m, nil
+		}
+		var cmd tea.Cmd
+		m.spinner, cmd = m.spinner.Update(msg)
+		return m, cmd
+
+	case latencyTickMsg:
+		// Only probe while the listener owns the reader, so it sees the PONG.
+		if m.conn == nil || !m.broadcastListening || m.pauseBroadcast {
+			return m, latencyTickCmd()
+		}
+		m.pingSentAt = time.Now()
+		return m, tea.Batch(sendLineCmd(m.conn, "PING"), latencyTickCmd())
+
 	case broadcastMsg:
-		msgText := string(msg)
-		if msgText != "" && strings.HasPrefix(msgText, "[order]") {
-			m.broadcasts = append(m.broadcasts, msgText)
-			if len(m.broadcasts) > 10 {
-				m.broadcasts = m.broadcasts[1:]
+		cmds = append(cmds, m.applyBroadcasts(msg)...)
+		// Refresh on every poll so relative times stay current.
+		m.refreshFeed()
+		// An open form keeps the items it was built with, so a changed menu
+		// is fetched once it closes. Without a menu yet, the next fetch
+		// gets the new one anyway.
+		if m.menuStale && !m.loading && m.form == nil {
+			m.menuStale = false
+			if len(m.menu) > 0 {
+				m.loading = true
+				m.refreshingMenu = true
+				m.pauseBroadcast = true
+				m.status = "Menu changed, refreshing..."
+				return m, tea.Batch(append(cmds, fetchMenuCmd(m.conn, m.reader), m.spinner.Tick)...)
 			}
 		}
 		if m.pauseBroadcast {
-			return m, nil
+			return m, tea.Batch(cmds...)
 		}
-		return m, listenForBroadcastsCmd(m.conn, m.reader)
+		return m, tea.Batch(append(cmds, listenForBroadcastsCmd(m.conn, m.reader))...)
 	case statusMsg:
 		msgStr := string(msg)
 		m.status = msgStr
@@ -238,35 +1003,289 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 			m.broadcastListening = false
 			m.reader = nil
+			if m.maxReconnects > 0 && !m.reconnecting {
+				m.reconnecting = true
+				m.reconnectAttempt = 0
+				return m, m.scheduleReconnect()
+			}
+		}
+		if strings.HasPrefix(msgStr, "Connect failed") {
+			if m.reconnecting {
+				return m, m.scheduleReconnect()
+			}
+			m.status += fmt.Sprintf(" Press '%s' to retry.", m.keys.Reconnect)
+		}
+		if msgStr == copiedStatus {
+			return m, tea.Tick(3*time.Second, func(time.Time) tea.Msg { return clearStatusMsg(msgStr) })
 		}
 		return m, nil
 
+	case flashDoneMsg:
+		if !time.Now().Before(m.flashUntil) {
+			m.refreshFeed()
+		}
+		return m, nil
+	case clearStatusMsg:
+		if m.status == string(msg) {
+			m.status = ""
+		}
+		return m, nil
+
+	case reconnectMsg:
+		if !m.reconnecting || msg.attempt != m.reconnectAttempt {
+			return m, nil
+		}
+		m.status = fmt.Sprintf("Reconnecting (attempt %d)...", msg.attempt)
+		return m, connectCmd(m.host, m.tlsConfig, m.room, m.lastSeq, m.connectTimeout)
+
 	case tea.KeyMsg:
+		if m.chatInput != nil {
+			switch msg.String() {
+			case "esc":
+				m.chatInput, m.chatErr = nil, ""
+				return m, nil
+			case "enter":
+				return m, m.sendChat()
+			case "ctrl+c":
+				// Quit as usual below.
+			default:
+				var cmd tea.Cmd
+				*m.chatInput, cmd = m.chatInput.Update(msg)
+				return m, cmd
+			}
+		}
+		if m.orderBar != nil {
+			switch msg.String() {
+			case "esc":
+				m.orderBar, m.orderBarErr = nil, ""
+				return m, nil
+			case "enter":
+				return m, m.submitOrderBar()
+			case "ctrl+c":
+				// Quit as usual below.
+			default:
+				var cmd tea.Cmd
+				*m.orderBar, cmd = m.orderBar.Update(msg)
+				return m, cmd
+			}
+		}
+		if m.browsing {
+			switch msg.String() {
+			case "esc", m.keys.BrowseMenu:
+				m.browsing = false
+				return m, nil
+			case m.keys.Quit, "ctrl+c":
+				// Quit as usual below.
+			default:
+				var cmd tea.Cmd
+				m.menuView, cmd = m.menuView.Update(msg)
+				return m, cmd
+			}
+		}
+		if m.readOnly && !m.displayKey(msg.String()) {
+			return m, nil
+		}
 		switch msg.String() {
-		case "q", "ctrl+c", "esc":
+		case m.keys.Quit, "ctrl+c", "esc":
 			if m.conn != nil {
 				_ = m.conn.Close()
 			}
 			return m, tea.Quit
-		case "r":
-			// Reconnect
+		case m.keys.Reconnect:
 			if m.conn != nil {
 				_ = m.conn.Close()
 				m.conn = nil
 			}
 			m.broadcastListening = false
 			m.reader = nil
-			m.status = "Reconnecting..."
-			return m, connectCmd(m.host)
-		case "n":
+			m.reconnecting = false
+			m.reconnectAttempt = 0
+			m.status = fmt.Sprintf("Connecting to %s...", m.host)
+			return m, connectCmd(m.host, m.tlsConfig, m.room, m.lastSeq, m.connectTimeout)
+		case m.keys.Save:
+			if m.lastOrder == nil || m.lastTotal <= 0 {
+				m.status = "No submitted order to save yet."
+				return m, nil
+			}
+			return m, saveOrderCmd(m.ordersFile, m.receipt())
+		case m.keys.Copy:
+			if m.lastOrder == nil || m.lastTotal <= 0 {
+				m.status = "No submitted order to copy yet."
+				return m, nil
+			}
+			return m, copyOrderCmd(m.receipt())
+		case m.keys.SaveFavorite:
+			if m.lastOrder == nil || m.lastTotal <= 0 {
+				m.status = "No submitted order to save as favorite yet."
+				return m, nil
+			}
+			lines := m.lastOrder.lines()
+			if len(lines) != 1 || len(lines[0].Modifiers) > 0 {
+				m.status = "Only single-item orders without modifiers can be favorites."
+				return m, nil
+			}
+			m.favorite = &favorite{Name: m.lastOrder.Name, ItemID: lines[0].ItemID, Quantity: lines[0].Quantity}
+			return m, saveFavoriteCmd(m.configFile, *m.favorite)
+		case m.keys.QuickOrder:
+			if m.loading || m.form != nil {
+				return m, nil
+			}
+			if m.favorite == nil {
+				m.status = fmt.Sprintf("No favorite yet. Press '%s' after an order to save it.", m.keys.SaveFavorite)
+				return m, nil
+			}
+			if m.conn == nil {
+				m.status = fmt.Sprintf("Not connected. Press '%s' to reconnect.", m.keys.Reconnect)
+				return m, nil
+			}
+			m.err, m.serverError = nil, ""
+			if len(m.menu) > 0 {
+				return m, m.quickOrder()
+			}
+			m.loading = true
+			m.quickOrdering = true
+			m.pauseBroadcast = true
+			m.status = "Loading menu..."
+			return m, tea.Batch(fetchMenuCmd(m.conn, m.reader), m.spinner.Tick)
+		case m.keys.RetryOrder:
+			if m.loading || m.form != nil {
+				return m, nil
+			}
+			if !m.retryable {
+				m.status = "No failed order to retry."
+				return m, nil
+			}
+			if m.conn == nil {
+				m.status = fmt.Sprintf("Not connected. Press '%s' to reconnect, then '%s' to retry the order.", m.keys.Reconnect, m.keys.RetryOrder)
+				return m, nil
+			}
+			// The resent order keeps its nonce, so if the first attempt did
+			// get through, the server answers with that order instead of
+			// placing it twice.
+			retries := m.orderRetries + 1
+			m.err, m.serverError = nil, ""
+			cmd := m.sendOrder(*m.lastOrder, fmt.Sprintf("Retrying order (retry %d)...", retries))
+			m.orderRetries = retries
+			return m, cmd
+		case m.keys.Chat:
+			// Chat and ordering take turns: the input opens only while no
+			// form or order bar is, and neither opens while it is.
+			if m.loading || m.form != nil || m.orderBar != nil {
+				return m, nil
+			}
+			if m.conn == nil {
+				m.status = fmt.Sprintf("Not connected. Press '%s' to reconnect.", m.keys.Reconnect)
+				return m, nil
+			}
+			in := textinput.New()
+			in.Prompt = ""
+			in.Placeholder = "message, /me <action> or /msg <user> <text>"
+			in.Cursor.SetMode(cursor.CursorStatic)
+			in.Focus()
+			m.chatInput, m.chatErr = &in, ""
+			// Chat shows up under Activity.
+			if !m.showActivity {
+				m.showActivity = true
+				m.refreshFeed()
+			}
+			return m, nil
+		case m.keys.OrderBar:
 			if m.loading || m.form != nil {
 				return m, nil
 			}
 			if m.conn == nil {
-				m.status = "Not connected. Press 'r' to reconnect."
+				m.status = fmt.Sprintf("Not connected. Press '%s' to reconnect.", m.keys.Reconnect)
 				return m, nil
 			}
-			m.err = nil
+			bar := textinput.New()
+			bar.Prompt = ""
+			bar.Placeholder = "name,itemId,qty"
+			bar.Cursor.SetMode(cursor.CursorStatic)
+			if m.defaultName != "" {
+				bar.SetValue(m.defaultName + ",")
+			}
+			bar.Focus()
+			m.orderBar, m.orderBarErr = &bar, ""
+			if len(m.menu) > 0 {
+				return m, nil
+			}
+			// Item IDs are checked against the menu, so fetch it now.
+			m.err, m.serverError = nil, ""
+			m.loading = true
+			m.refreshingMenu = true
+			m.pauseBroadcast = true
+			m.status = "Loading menu..."
+			return m, tea.Batch(fetchMenuCmd(m.conn, m.reader), m.spinner.Tick)
+		case m.keys.Receipt:
+			if len(m.session) == 0 {
+				m.status = "No orders this session yet."
+				return m, nil
+			}
+			return m, writeReceiptCmd(m.receiptFile, m.session)
+		case "up", "k":
+			m.feed.ScrollUp(1)
+			return m, nil
+		case "down", "j":
+			m.feed.ScrollDown(1)
+			return m, nil
+		case "pgup":
+			m.feed.PageUp()
+			return m, nil
+		case "pgdown":
+			m.feed.PageDown()
+			return m, nil
+		case m.keys.Activity:
+			m.showActivity = !m.showActivity
+			m.refreshFeed()
+			m.feed.GotoBottom()
+			return m, nil
+		case m.keys.PauseFeed:
+			m.feedPaused = !m.feedPaused
+			if m.feedPaused {
+				m.status = "Order feed paused"
+				return m, nil
+			}
+			for _, e := range m.held {
+				m.broadcasts.push(e)
+			}
+			m.status = fmt.Sprintf("Order feed resumed, %d new", len(m.held))
+			var cmd tea.Cmd
+			if len(m.held) > 0 {
+				cmd = m.flashNewest()
+			}
+			m.held = nil
+			m.refreshFeed()
+			return m, cmd
+		case m.keys.ClearFeed:
+			if m.showActivity {
+				m.activity.clear()
+			} else {
+				m.broadcasts.clear()
+			}
+			m.refreshFeed()
+			m.status = "Feed cleared"
+			return m, nil
+		case m.keys.Theme:
+			m.themeMode = themeModes[(slices.Index(themeModes, m.themeMode)+1)%len(themeModes)]
+			m.colors = newPalette(m.themeMode, m.dark, m.light)
+			m.refreshFeed()
+			m.status = "Theme: " + m.themeMode
+			return m, nil
+		case m.keys.CancelReconnect:
+			if m.reconnecting {
+				m.reconnecting = false
+				m.status = fmt.Sprintf("Auto-reconnect canceled. Press '%s' to reconnect.", m.keys.Reconnect)
+			}
+			return m, nil
+		case m.keys.NewOrder:
+			if m.loading || m.form != nil {
+				return m, nil
+			}
+			if m.conn == nil {
+				m.status = fmt.Sprintf("Not connected. Press '%s' to reconnect.", m.keys.Reconnect)
+				return m, nil
+			}
+			m.err, m.serverError = nil, ""
 			if len(m.menu) > 0 {
 				m.form = m.buildForm()
 				return m, m.form.Init()
@@ -274,141 +1293,570 @@ func (m model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.loading = true
 			m.pauseBroadcast = true
 			m.status = "Loading menu..."
-			return m, fetchMenuCmd(m.conn, m.reader)
-		}
-
+			return m, tea.Batch(fetchMenuCmd(m.conn, m.reader), m.spinner.Tick)
+		case m.keys.BrowseMenu:
+			m.browsing = true
+			m.refreshMenuView()
+			m.menuView.GotoTop()
+			if len(m.menu) > 0 || m.loading || m.conn == nil {
+				return m, nil
+			}
+			m.err, m.serverError = nil, ""
+			m.loading = true
+			m.refreshingMenu = true
+			m.pauseBroadcast = true
+			m.status = "Loading menu..."
+			return m, tea.Batch(fetchMenuCmd(m.conn, m.reader), m.spinner.Tick)
+		case m.keys.RefreshMenu:
+			if m.loading {
+				return m, nil
+			}
+			if m.conn == nil {
+				m.status = fmt.Sprintf("Not connected. Press '%s' to reconnect.", m.keys.Reconnect)
+				return m, nil
+			}
+			m.err, m.serverError = nil, ""
+			m.loading = true
+			m.refreshingMenu = true
+			m.pauseBroadcast = true
+			m.status = "Refreshing menu..."
+			return m, tea.Batch(fetchMenuCmd(m.conn, m.reader), m.spinner.Tick)
+		}
+
 	case tea.WindowSizeMsg:
 		m.width = msg.Width
 		m.height = msg.Height
+		m.feed.Width, m.feed.Height = m.feedSize()
+		m.refreshFeed()
+		m.refreshMenuView()
 	}
 
 	return m, nil
 }
 
+// applyBroadcasts handles lines from the server's broadcast stream. Numbered
+// lines already seen, e.g. replayed again after a reconnect, are skipped.
+func (m *model) applyBroadcasts(lines []string) []tea.Cmd {
+	var (
+		cmds  []tea.Cmd
+		flash bool
+	)
+	for _, line := range lines {
+		if line == "PONG" {
+			if !m.pingSentAt.IsZero() {
+				m.rtt = time.Since(m.pingSentAt)
+				m.pingSentAt = time.Time{}
+			}
+			continue
+		}
+		seq, line := splitSeq(line)
+		if seq > 0 {
+			if seq <= m.lastSeq {
+				continue
+			}
+			m.lastSeq = seq
+		}
+		switch tag, at, body := parseBroadcast(line); tag {
+
+		case "order":
+			if m.feedPaused {
+				m.held = append(m.held, feedEntry{tag: tag, text: body, at: at})
+				continue
+			}
+			m.broadcasts.push(feedEntry{tag: tag, text: body, at: at})
+			flash = true
+		case "summary":
+			m.summary = body
+		case "menu":
+			m.activity.push(feedEntry{tag: tag, text: body, at: at})
+			m.menuStale = true
+		case "status":
+			if id, state, ok := strings.Cut(body, " "); ok && id != "" && id == m.lastOrderID {
+				m.lastStatus = state
+			}
+		case "join", "leave", "rename", "kick", "pm", "action", "server", "":
+			m.activity.push(feedEntry{tag: tag, text: body, at: at})
+			if tag == "rename" && m.connID != "" {
+				if _, newName, ok := strings.Cut(body, "("+m.connID+") -> "); ok {
+					m.username = newName
+					m.pendingName = ""
+				}
+			}
+		case "error":
+			switch {
+			case body == "username taken" && m.pendingName != "":
+				cmds = append(cmds, m.requestName(m.pendingName, m.nameAttempt+1))
+			case body == "invalid username" && m.pendingName != "":
+				m.status = fmt.Sprintf("Username %q rejected: invalid", m.pendingName)
+				m.pendingName = ""
+			case m.chatInput != nil:
+				// e.g. "message too long" or "no such user" for /msg.
+				m.chatErr = body
+			}
+		case "info":
+			if name, ok := strings.CutPrefix(body, "name set to "); ok {
+				m.username = name
+				m.pendingName = ""
+			}
+			if name, ok := strings.CutPrefix(body, "username unchanged: "); ok {
+				m.username = name
+				m.pendingName = ""
+			}
+		}
+	}
+	if flash {
+		cmds = append(cmds, m.flashNewest())
+	}
+	return cmds
+}
+
+// flashDuration is how long the newest order stays highlighted.
+const flashDuration = 2 * time.Second
+
+// flashNewest highlights the newest order for flashDuration; a batch of
+// orders flashes only its last one.
+func (m *model) flashNewest() tea.Cmd {
+	m.flashUntil = time.Now().Add(flashDuration)
+	return tea.Tick(flashDuration, func(time.Time) tea.Msg { return flashDoneMsg{} })
+}
+
 func (m model) renderHeader() string {
-	titleStyle := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("212"))
+	titleStyle := lipgloss.NewStyle().Bold(true).Foreground(m.colors.Accent)
 	hostStyle := lipgloss.NewStyle().Faint(true)
 
 	title := titleStyle.Render(m.title)
-	host := hostStyle.Render(m.host)
+	if m.showBanner() {
+		title = titleStyle.Render(m.banner)
+	}
+	hostText := m.host
+	if m.room != "" {
+		hostText += " #" + m.room
+	}
+	if m.username != "" {
+		hostText += " · " + m.username
+	}
+	host := hostStyle.Render(hostText)
 
 	header := lipgloss.JoinVertical(lipgloss.Center, title, host)
 	return lipgloss.NewStyle().Width(m.width).Align(lipgloss.Center).Render(header)
 }
 
+// minBodyHeight is the least room the panels keep; a taller banner gives way
+// to the plain title.
+const minBodyHeight = 10
+
+// showBanner reports whether the banner fits the terminal.
+func (m model) showBanner() bool {
+	if m.banner == "" {
+		return false
+	}
+	return lipgloss.Width(m.banner) <= m.width && m.height-5-lipgloss.Height(m.banner)-lipgloss.Height(m.footerView()) >= minBodyHeight
+}
+
+// bodyHeight is the height inside the panel borders, after the header, the
+// footer, the blank lines around them and the borders themselves.
+func (m model) bodyHeight() int {
+	return m.height - 4 - lipgloss.Height(m.renderHeader()) - lipgloss.Height(m.footerView())
+}
+
 func (m model) renderLeftColumn() string {
 	lines := []string{}
 
+	if m.chatInput != nil {
+		w, _ := m.columnSize()
+		m.chatInput.Width = max(w-5, 1)
+		lines = append(lines,
+			lipgloss.NewStyle().Bold(true).Render("Chat: ")+m.chatInput.View(),
+			lipgloss.NewStyle().Faint(true).Render("enter to send · esc to close"))
+		if m.chatErr != "" {
+			lines = append(lines, lipgloss.NewStyle().Foreground(m.colors.Error).Render(m.chatErr))
+		}
+		lines = append(lines, "")
+	}
+
+	if m.orderBar != nil {
+		w, _ := m.columnSize()
+		m.orderBar.Width = max(w-4, 1)
+		lines = append(lines,
+			lipgloss.NewStyle().Bold(true).Render("Order: ")+m.orderBar.View(),
+			lipgloss.NewStyle().Faint(true).Render("name,itemId,qty · enter to submit · esc to cancel"))
+		if m.orderBarErr != "" {
+			lines = append(lines, lipgloss.NewStyle().Foreground(m.colors.Error).Render(m.orderBarErr))
+		}
+		lines = append(lines, "")
+	}
+
 	if m.loading {
 		loadingText := "Loading..."
 		if m.status != "" {
 			loadingText = m.status
 		}
-		lines = append(lines, "Status: "+lipgloss.NewStyle().Foreground(lipgloss.Color("178")).Render(loadingText))
+		lines = append(lines, lipgloss.NewStyle().Foreground(m.colors.Warn).Render(m.spinner.View()+loadingText))
 	} else if m.status != "" {
-		lines = append(lines, "Status: "+m.status)
+		lines = append(lines, m.status)
 	}
 
 	if m.err != nil {
-		lines = append(lines, lipgloss.NewStyle().Foreground(lipgloss.Color("9")).Render(fmt.Sprintf("Error: %v", m.err)))
+		lines = append(lines, lipgloss.NewStyle().Foreground(m.colors.Error).Render(fmt.Sprintf("Error: %v", m.err)))
+	}
+	if m.serverError != "" {
+		lines = append(lines, lipgloss.NewStyle().Foreground(m.colors.Warn).Bold(true).Render(m.serverError))
+	}
+	if m.summary != "" {
+		lines = append(lines, lipgloss.NewStyle().Faint(true).Render("Café: "+m.summary))
+	}
+	if m.sessionCount > 0 {
+		lines = append(lines, fmt.Sprintf("Orders this session: %d ($%.2f)", m.sessionCount, m.sessionTotal))
 	}
 
 	if m.lastOrder != nil {
 		lines = append(lines, "", lipgloss.NewStyle().Bold(true).Render("Last Order:"))
-		lines = append(lines, fmt.Sprintf("  Name: %s", m.lastOrder.Name))
-		var label string
-		for _, it := range m.menu {
-			if it.ID == m.lastOrder.ItemID {
-				label = it.Name
-				break
+		if m.lastOrderID != "" {
+			lines = append(lines, fmt.Sprintf("  Order ID: %s", m.lastOrderID))
+			if m.lastStatus != "" {
+				lines = append(lines, fmt.Sprintf("  Status: %s", m.lastStatus))
 			}
 		}
-		if label != "" {
-			lines = append(lines, fmt.Sprintf("  Item: %s", label))
+		lines = append(lines, fmt.Sprintf("  Name: %s", m.lastOrder.Name))
+		if ol := m.lastOrder.lines(); len(ol) == 1 {
+			lines = append(lines, fmt.Sprintf("  Item: %s", m.lineLabel(ol[0])))
+			lines = append(lines, fmt.Sprintf("  Quantity: %s", m.lineQuantity(ol[0])))
 		} else {
-			lines = append(lines, fmt.Sprintf("  Item: %s", m.lastOrder.ItemID))
+			lines = append(lines, "  Items:")
+			for _, l := range ol {
+				lines = append(lines, fmt.Sprintf("    %s × %s", m.lineQuantity(l), m.lineLabel(l)))
+			}
+		}
+		if m.lastOrderID != "" {
+			lines = append(lines, fmt.Sprintf("  Subtotal: $%.2f", m.lastSubtotal))
+			if m.lastDiscount > 0 {
+				lines = append(lines, fmt.Sprintf("  Discount: -$%.2f", m.lastDiscount))
+			}
+			lines = append(lines,
+				fmt.Sprintf("  Tax: $%.2f", m.lastTax),
+				fmt.Sprintf("  Tip: $%.2f", m.lastTip),
+				fmt.Sprintf("  Total: $%.2f", m.lastTotal))
 		}
-		lines = append(lines, fmt.Sprintf("  Quantity: %d", m.lastOrder.Quantity))
 	}
 
 	content := lipgloss.JoinVertical(lipgloss.Left, lines...)
-	return lipgloss.NewStyle().
-		Width(m.width/2 - 2).
-		Height(m.height - 6).
-		Padding(1).
-		Border(lipgloss.RoundedBorder()).
-		Render(content)
+	return m.column(m.columnTitle("Status"), content)
 }
 
-func (m model) renderRightColumn() string {
+// renderFeedLines renders one line per order broadcast, wrapped to the feed width.
+func (m model) renderFeedLines() []string {
+	bulletStyle := lipgloss.NewStyle().Foreground(m.colors.Bullet)
+	nameStyle := lipgloss.NewStyle().Foreground(m.colors.Name).Bold(true)
+	itemStyle := lipgloss.NewStyle().Foreground(m.colors.Item)
+	priceStyle := lipgloss.NewStyle().Foreground(m.colors.Price).Bold(true)
+	timeStyle := lipgloss.NewStyle().Faint(true)
+	youStyle := lipgloss.NewStyle().Bold(true).Foreground(m.colors.Accent)
+	wrap := lipgloss.NewStyle().Width(max(m.feed.Width, 1))
+
 	lines := []string{}
-	headerStyle := lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("212"))
-	lines = append(lines, headerStyle.Render("Recent Orders:"))
-	lines = append(lines, "")
+	entries := m.broadcasts.items()
+	flashing := time.Now().Before(m.flashUntil)
+	for i, b := range entries {
+		parts := strings.SplitN(b.text, " ordered ", 2)
+		if len(parts) == 2 {
+			customer := parts[0]
+			orderDetails := parts[1]
+
+			// Best-effort: orders carry only the customer name, so anyone
+			// else ordering under the same name is marked as well.
+			who := nameStyle.Render(customer)
+			mine := m.myName != "" && customer == m.myName
+			if mine {
+				who += " " + youStyle.Render("(you)")
+			}
 
-	if len(m.broadcasts) == 0 {
-		lines = append(lines, lipgloss.NewStyle().Faint(true).Render("No orders yet..."))
-	} else {
-		bulletStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("141"))
-		nameStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("86")).Bold(true)
-		itemStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("117"))
-		priceStyle := lipgloss.NewStyle().Foreground(lipgloss.Color("220")).Bold(true)
-
-		for _, b := range m.broadcasts {
-			msg := strings.TrimPrefix(b, "[order] ")
-			parts := strings.SplitN(msg, " ordered ", 2)
-			if len(parts) == 2 {
-				customer := parts[0]
-				orderDetails := parts[1]
-
-				line := fmt.Sprintf("%s %s ordered %s",
-					bulletStyle.Render("•"),
-					nameStyle.Render(customer),
-					itemStyle.Render(orderDetails))
-
-				if idx := strings.Index(orderDetails, "($"); idx != -1 {
-					priceStart := idx
-					priceEnd := strings.Index(orderDetails[priceStart:], ")")
-					if priceEnd != -1 {
-						priceEnd += priceStart + 1
-						beforePrice := orderDetails[:priceStart]
-						priceText := orderDetails[priceStart:priceEnd]
-
-						line = fmt.Sprintf("%s %s ordered %s %s",
-							bulletStyle.Render("•"),
-							nameStyle.Render(customer),
-							itemStyle.Render(beforePrice),
-							priceStyle.Render(priceText))
-					}
+			// The flashed line is drawn plain in reverse video, since the
+			// colored parts would each end the reverse.
+			if flashing && i == len(entries)-1 {
+				if mine {
+					customer += " (you)"
 				}
+				plain := fmt.Sprintf("• %s ordered %s %s", customer, orderDetails, relativeTime(b.at))
+				lines = append(lines, wrap.Reverse(true).Bold(true).Render(plain))
+				continue
+			}
 
-				lines = append(lines, line)
+			line := fmt.Sprintf("%s %s ordered %s",
+				bulletStyle.Render("•"),
+				who,
+				itemStyle.Render(orderDetails))
+
+			if idx := strings.Index(orderDetails, "($"); idx != -1 {
+				priceStart := idx
+				priceEnd := strings.Index(orderDetails[priceStart:], ")")
+				if priceEnd != -1 {
+					priceEnd += priceStart + 1
+					beforePrice := orderDetails[:priceStart]
+					priceText := orderDetails[priceStart:priceEnd]
+
+					line = fmt.Sprintf("%s %s ordered %s %s",
+						bulletStyle.Render("•"),
+						who,
+						itemStyle.Render(beforePrice),
+						priceStyle.Render(priceText))
+				}
 			}
+
+			lines = append(lines, wrap.Render(line+" "+timeStyle.Render(relativeTime(b.at))))
 		}
 	}
+	return lines
+}
 
-	content := lipgloss.JoinVertical(lipgloss.Left, lines...)
+// renderActivityLines renders one line per chat message or join, leave,
+// rename and private message broadcast, wrapped to the feed width.
+func (m model) renderActivityLines() []string {
+	nameStyle := lipgloss.NewStyle().Foreground(m.colors.Name).Bold(true)
+	joinStyle := lipgloss.NewStyle().Foreground(m.colors.OK)
+	leaveStyle := lipgloss.NewStyle().Foreground(m.colors.Error)
+	renameStyle := lipgloss.NewStyle().Foreground(m.colors.Warn)
+	pmStyle := lipgloss.NewStyle().Foreground(m.colors.Accent).Italic(true)
+	actionStyle := lipgloss.NewStyle().Foreground(m.colors.Name).Italic(true)
+	timeStyle := lipgloss.NewStyle().Faint(true)
+	wrap := lipgloss.NewStyle().Width(max(m.feed.Width, 1))
+
+	lines := []string{}
+	for _, e := range m.activity.items() {
+		var line string
+		switch e.tag {
+		case "join":
+			line = joinStyle.Render("→ " + e.text + " joined")
+		case "leave":
+			line = leaveStyle.Render("← " + e.text + " left")
+		case "rename":
+			line = renameStyle.Render("✎ " + e.text)
+		case "kick":
+			line = leaveStyle.Render("✖ " + e.text)
+		case "pm":
+			line = pmStyle.Render("✉ " + e.text)
+		case "action":
+			line = actionStyle.Render("* " + e.text)
+		case "menu":
+			line = renameStyle.Render("☰ menu " + e.text)
+		default:
+			if who, text, ok := strings.Cut(e.text, ": "); ok {
+				line = nameStyle.Render(who) + ": " + text
+			} else {
+				line = e.text
+			}
+		}
+		lines = append(lines, wrap.Render(line+" "+timeStyle.Render(relativeTime(e.at))))
+	}
+	return lines
+}
+
+// refreshFeed re-renders the feed viewport with orders or activity. It keeps
+// following new lines only while the user is scrolled to the bottom.
+func (m *model) refreshFeed() {
+	follow := m.feed.AtBottom()
+	if m.showActivity {
+		m.feed.SetContent(strings.Join(m.renderActivityLines(), "\n"))
+	} else {
+		m.feed.SetContent(strings.Join(m.renderFeedLines(), "\n"))
+	}
+	if follow {
+		m.feed.GotoBottom()
+	}
+}
+
+func (m model) renderRightColumn() string {
+	title, entries, empty := "Recent Orders", m.broadcasts, "No orders yet..."
+	if m.showActivity {
+		title, entries, empty = "Activity", m.activity, "No activity yet..."
+	}
+	title = m.columnTitle(title)
+	if m.feedPaused && !m.showActivity {
+		title += " " + lipgloss.NewStyle().Bold(true).Foreground(m.colors.Warn).Render(fmt.Sprintf("PAUSED (%d new)", len(m.held)))
+	}
+
+	// The footer can wrap differently as it changes, so size the feed to
+	// the column as it is now.
+	m.feed.Width, m.feed.Height = m.feedSize()
+	content := m.feed.View()
+	if entries.len() == 0 {
+		content = lipgloss.NewStyle().Faint(true).Render(empty)
+	}
+	return m.column(title, content)
+}
+
+// refreshMenuView sizes the menu browser to the screen and re-renders the
+// cached menu into it.
+func (m *model) refreshMenuView() {
+	// Inside the full-width box: minus border, padding and the title lines.
+	m.menuView.Width = max(m.width-4, 1)
+	m.menuView.Height = max(m.bodyHeight()-4, 1)
+
+	if len(m.menu) == 0 {
+		m.menuView.SetContent(lipgloss.NewStyle().Faint(true).Render("No menu loaded yet..."))
+		return
+	}
+	nameStyle := lipgloss.NewStyle().Bold(true).Foreground(m.colors.Item)
+	priceStyle := lipgloss.NewStyle().Foreground(m.colors.Price)
+	faint := lipgloss.NewStyle().Faint(true)
+	descStyle := faint.Width(m.menuView.Width - 2).PaddingLeft(2)
+	var lines []string
+	for i, it := range m.menu {
+		if i > 0 {
+			lines = append(lines, "")
+		}
+		head := nameStyle.Render(it.Name) + "  " + priceStyle.Render(unitPrice(it))
+		switch {
+		case it.soldOut():
+			head += "  " + lipgloss.NewStyle().Foreground(m.colors.Error).Render("sold out")
+		case it.Stock != nil:
+			head += "  " + faint.Render(formatQuantity(*it.Stock, it.Unit)+" left")
+		}
+		if it.Category != "" {
+			head += "  " + faint.Render("· "+it.Category)
+		}
+		lines = append(lines, head)
+		if it.Description != "" {
+			lines = append(lines, descStyle.Render(it.Description))
+		}
+		for _, g := range it.Modifiers {
+			var choices []string
+			for _, o := range modifierOptions(g) {
+				choices = append(choices, o.Key)
+			}
+			lines = append(lines, descStyle.Render(g.Name+": "+strings.Join(choices, ", ")))
+		}
+	}
+	m.menuView.SetContent(strings.Join(lines, "\n"))
+}
+
+// renderMenuBrowser renders the menu browser across the whole body.
+func (m model) renderMenuBrowser() string {
+	m.menuView.Height = max(m.bodyHeight()-4, 1)
+	title := lipgloss.NewStyle().Bold(true).Foreground(m.colors.Accent).Render("Menu")
+	hint := lipgloss.NewStyle().Faint(true).Render(fmt.Sprintf("  ↑/↓ scroll · esc or %s to close", m.keys.BrowseMenu))
+	content := lipgloss.JoinVertical(lipgloss.Left, title+hint, "", m.menuView.View())
 	return lipgloss.NewStyle().
-		Width(m.width/2 - 2).
-		Height(m.height - 6).
+		Width(max(m.width-2, 1)).
+		Height(max(m.bodyHeight(), 1)).
 		Padding(1).
 		Border(lipgloss.RoundedBorder()).
+		BorderForeground(m.colors.Border).
+		Render(content)
+}
+
+// narrowWidth is the terminal width below which the columns are stacked.
+const narrowWidth = 60
+
+func (m model) narrow() bool {
+	return m.width < narrowWidth
+}
+
+// displayKey reports whether key works in read-only mode, which keeps the
+// keys for watching the feed and the connection.
+func (m model) displayKey(key string) bool {
+	switch key {
+	case m.keys.Quit, "ctrl+c", "esc", m.keys.Reconnect, m.keys.CancelReconnect,
+		m.keys.Activity, m.keys.PauseFeed, m.keys.ClearFeed, m.keys.Theme,
+		"up", "k", "down", "j", "pgup", "pgdown":
+		return true
+	}
+	return false
+}
+
+// columnSize is the width and height inside the border of each column: half
+// the screen side by side, or the full width and half the height stacked.
+// In read-only mode the feed is the only column and gets the whole body.
+func (m model) columnSize() (int, int) {
+	if m.readOnly {
+		return max(m.width-2, 1), max(m.bodyHeight(), 1)
+	}
+	if m.narrow() {
+		return max(m.width-2, 1), max((m.bodyHeight()-2)/2, 1)
+	}
+	return max(m.width/2-2, 1), max(m.bodyHeight(), 1)
+}
+
+// feedSize is the feed viewport's size inside its column, minus padding.
+func (m model) feedSize() (int, int) {
+	w, h := m.columnSize()
+	return max(w-2, 1), max(h-2, 1)
+}
+
+// columnTitle styles a column's title for its top border.
+func (m model) columnTitle(title string) string {
+	return lipgloss.NewStyle().Bold(true).Foreground(m.colors.Accent).Render(title)
+}
+
+// column renders content in a bordered column box with title set into the
+// top border, e.g. "╭─ Status ───╮".
+func (m model) column(title, content string) string {
+	w, h := m.columnSize()
+	border := lipgloss.RoundedBorder()
+	edge := lipgloss.NewStyle().Foreground(m.colors.Border)
+	// The top edge holds "─ ", the title and a space before the fill.
+	title = lipgloss.NewStyle().MaxWidth(max(w-3, 0)).Render(title)
+	fill := max(w-3-lipgloss.Width(title), 0)
+	top := edge.Render(border.TopLeft+border.Top+" ") + title + edge.Render(" "+strings.Repeat(border.Top, fill)+border.TopRight)
+	if w < 3 {
+		top = edge.Render(border.TopLeft + strings.Repeat(border.Top, w) + border.TopRight)
+	}
+	box := lipgloss.NewStyle().
+		Width(w).
+		Height(h).
+		Padding(1).
+		Border(border).
+		BorderTop(false).
+		BorderForeground(m.colors.Border).
 		Render(content)
+	return lipgloss.JoinVertical(lipgloss.Left, top, box)
 }
 
 func (m model) renderFooter() string {
 	connStatus := ""
 	if m.conn != nil {
-		connStatus = lipgloss.NewStyle().Foreground(lipgloss.Color("10")).Render("● Connected")
+		label := "● Connected"
+		if m.rtt > 0 {
+			label += fmt.Sprintf(" (%dms)", m.rtt.Milliseconds())
+		}
+		connStatus = lipgloss.NewStyle().Foreground(m.colors.OK).Render(label)
+	} else if m.reconnecting {
+		connStatus = lipgloss.NewStyle().Foreground(m.colors.Warn).Render(fmt.Sprintf("● Reconnecting (attempt %d)...", m.reconnectAttempt))
 	} else {
-		connStatus = lipgloss.NewStyle().Foreground(lipgloss.Color("9")).Render("● Disconnected")
+		connStatus = lipgloss.NewStyle().Foreground(m.colors.Error).Render("● Disconnected")
 	}
 
-	controls := lipgloss.NewStyle().Faint(true).Render("n: New Order  r: Reconnect  q: Quit")
+	view := "Activity"
+	if m.showActivity {
+		view = "Orders"
+	}
+	pause := "Pause"
+	if m.feedPaused {
+		pause = "Resume"
+	}
+	help := fmt.Sprintf("%s: New Order  %s: Quick Order  %s: Order Bar  %s: Chat  %s: Browse  %s: Menu  %s: Save  %s: Favorite  %s: Copy  %s: Receipt  %s: %s  %s: %s  %s: Clear  %s: Theme  ↑/↓: Scroll  %s: Reconnect  %s: Quit",
+		m.keys.NewOrder, m.keys.QuickOrder, m.keys.OrderBar, m.keys.Chat, m.keys.BrowseMenu, m.keys.RefreshMenu, m.keys.Save, m.keys.SaveFavorite, m.keys.Copy, m.keys.Receipt, m.keys.Activity, view, m.keys.PauseFeed, pause, m.keys.ClearFeed, m.keys.Theme, m.keys.Reconnect, m.keys.Quit)
+	if m.readOnly {
+		help = fmt.Sprintf("%s: %s  %s: %s  %s: Clear  %s: Theme  ↑/↓: Scroll  %s: Reconnect  %s: Quit",
+			m.keys.Activity, view, m.keys.PauseFeed, pause, m.keys.ClearFeed, m.keys.Theme, m.keys.Reconnect, m.keys.Quit)
+		// There is no status panel, so the status goes next to the connection.
+		if m.status != "" {
+			connStatus += "  " + lipgloss.NewStyle().Faint(true).Render(m.status)
+		}
+	}
+	if m.retryable {
+		help = m.keys.RetryOrder + ": Retry Order  " + help
+	}
+	if m.reconnecting {
+		help = m.keys.CancelReconnect + ": Cancel Reconnect  " + help
+	}
+	controls := lipgloss.NewStyle().Faint(true).Render(help)
 
 	leftSide := connStatus
 	rightSide := controls
 
+	if m.narrow() {
+		return lipgloss.NewStyle().Width(m.width).Render(lipgloss.JoinVertical(lipgloss.Left, leftSide, rightSide))
+	}
 	footer := lipgloss.JoinHorizontal(lipgloss.Top,
 		lipgloss.NewStyle().Width(m.width/2).Render(leftSide),
 		lipgloss.NewStyle().Width(m.width/2).Align(lipgloss.Right).Render(rightSide),
@@ -424,251 +1872,1664 @@ func (m model) View() string {
 
 	header := m.renderHeader()
 
-	var leftCol string
-	if m.form != nil {
-		formView := m.form.WithHeight(m.height - 10).View()
-		leftCol = lipgloss.NewStyle().
-			Width(m.width/2 - 2).
-			Height(m.height - 6).
+	var body string
+	switch {
+	case m.readOnly:
+		body = m.renderRightColumn()
+	case m.browsing:
+		body = m.renderMenuBrowser()
+	case m.form != nil && m.narrow():
+		// Too narrow for both: the form takes the whole body.
+		w := max(m.width-2, 1)
+		h := max(m.bodyHeight(), 1)
+		body = lipgloss.NewStyle().
+			Width(w).
+			Height(h).
 			Padding(1).
 			Border(lipgloss.RoundedBorder()).
-			Render(formView)
-	} else {
-		leftCol = m.renderLeftColumn()
+			BorderForeground(m.colors.Border).
+			Render(m.form.WithHeight(max(h-4, 1)).View())
+	case m.form != nil:
+		_, h := m.columnSize()
+		body = lipgloss.JoinHorizontal(lipgloss.Top, m.column(m.columnTitle("New Order"), m.form.WithHeight(max(h-4, 1)).View()), m.renderRightColumn())
+	case m.narrow():
+		body = lipgloss.JoinVertical(lipgloss.Left, m.renderLeftColumn(), m.renderRightColumn())
+	default:
+		body = lipgloss.JoinHorizontal(lipgloss.Top, m.renderLeftColumn(), m.renderRightColumn())
 	}
 
-	rightCol := m.renderRightColumn()
-	body := lipgloss.JoinHorizontal(lipgloss.Top, leftCol, rightCol)
-
-	footer := m.renderFooter()
-
 	return lipgloss.JoinVertical(lipgloss.Left,
 		header,
 		"",
 		body,
 		"",
-		footer,
+		m.footerView(),
 	)
 }
 
-// buildForm constructs the order form: Input (name) -> Select (menu) -> Input (qty) -> Confirm.
-func (m *model) buildForm() *huh.Form {
-	opts := make([]huh.Option[string], 0, len(m.menu))
-	for _, it := range m.menu {
-		opts = append(opts, huh.NewOption(fmt.Sprintf("%s - $%.2f", it.Name, it.Price), it.ID))
+// footerView is the footer, or the quit prompt in its place.
+func (m model) footerView() string {
+	if m.quitting {
+		return lipgloss.NewStyle().Width(m.width).Foreground(m.colors.Warn).Bold(true).
+			Render("Really quit? An order is in progress. (y/n)")
 	}
-
-	// Reset bound fields for a fresh form
-	m.formFields.name = ""
-	m.formFields.itemID = ""
-	m.formFields.quantityStr = ""
-	m.formFields.confirm = false
-
-	f := huh.NewForm(
-		huh.NewGroup(
-			huh.NewInput().
-				Title("Your name").
-				Prompt("> ").
-				Placeholder("Jane Doe").
-				Value(&m.formFields.name).
-				Validate(func(s string) error {
-					if strings.TrimSpace(s) == "" {
-						return errors.New("name is required")
-					}
-					return nil
-				}),
-			huh.NewSelect[string]().
-				Title("Menu item").
-				Options(opts...).
-				Value(&m.formFields.itemID).
-				Validate(func(v string) error {
-					if v == "" {
-						return errors.New("please select a menu item")
-					}
-					return nil
-				}),
-		),
-		huh.NewGroup(
-			huh.NewInput().
-				Title("Quantity").
-				Prompt("> ").
-				Placeholder("1").
-				Value(&m.formFields.quantityStr).
-				Validate(func(s string) error {
-					n, err := strconv.Atoi(strings.TrimSpace(s))
-					if err != nil || n <= 0 {
-						return errors.New("enter a positive integer")
-					}
-					return nil
-				}),
-			huh.NewConfirm().
-				Title("Place order?").
-				Affirmative("Yes").
-				Negative("No").
-				Value(&m.formFields.confirm),
-		),
-	).WithTheme(huh.ThemeBase())
-
-	return f
+	return m.renderFooter()
 }
 
-// connectCmd connects to the TCP server.
-func connectCmd(addr string) tea.Cmd {
-	return func() tea.Msg {
-		conn, err := net.DialTimeout("tcp", addr, 3*time.Second)
-		if err != nil {
-			return statusMsg(fmt.Sprintf("Connect failed: %v", err))
+// lineItem looks up a cart line's menu item, priced and named with its modifiers.
+func (m model) lineItem(l orderLine) (menuItem, bool) {
+	for _, it := range m.menu {
+		if it.ID == l.ItemID {
+			it, _ = it.withModifiers(l.Modifiers)
+			return it, true
 		}
-
-		return connectedMsg{conn: conn}
 	}
+	return menuItem{}, false
 }
 
-// fetchMenuCmd asks the server for a menu via the TCP connection.
-// Protocol (proposed):
-// - client: "MENU\n"
-// - server: single line JSON array: [{"id":"x","name":"..."}]\n
-func fetchMenuCmd(conn net.Conn, reader *bufio.Reader) tea.Cmd {
-	return func() tea.Msg {
-		if conn == nil || reader == nil {
-			return menuLoadedMsg{err: errors.New("not connected")}
-		}
-
-		time.Sleep(150 * time.Millisecond)
+// lineQuantity renders a cart line's quantity with its item's unit.
+func (m model) lineQuantity(l orderLine) string {
+	it, _ := m.lineItem(l)
+	return formatQuantity(l.Quantity, it.Unit)
+}
 
-		if _, err := fmt.Fprintln(conn, "MENU"); err != nil {
-			return menuLoadedMsg{err: fmt.Errorf("send MENU: %w", err)}
+// parseQuantity parses the quantity field for the chosen item: a positive
+// whole number, or any positive number for items sold by measure.
+func (m *model) parseQuantity(s string) (float64, error) {
+	for _, it := range m.menu {
+		if it.ID == m.formFields.itemID {
+			return parseItemQuantity(s, it.fractional())
 		}
+	}
+	return parseItemQuantity(s, false)
+}
 
-		_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
-		defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
-
-		var line string
-		for {
-			l, err := reader.ReadString('\n')
-			if err != nil {
-				return menuLoadedMsg{err: fmt.Errorf("read MENU: %w", err)}
-			}
-			l = strings.TrimRight(l, "\r\n")
-			if strings.HasPrefix(l, "[join]") || strings.HasPrefix(l, "[leave]") || strings.HasPrefix(l, "[rename]") || strings.HasPrefix(l, "[order]") {
-				continue
-			}
-			line = l
-			break
+// parseItemQuantity parses a positive quantity, whole unless fractional.
+func parseItemQuantity(s string, fractional bool) (float64, error) {
+	s = strings.TrimSpace(s)
+	if fractional {
+		q, err := strconv.ParseFloat(s, 64)
+		if err != nil || !(q > 0) || math.IsInf(q, 0) {
+			return 0, errors.New("enter a positive number")
 		}
+		return q, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n <= 0 {
+		return 0, errors.New("enter a positive integer")
+	}
+	return float64(n), nil
+}
 
-		if strings.HasPrefix(line, "[error]") {
-			return menuLoadedMsg{err: fmt.Errorf("server: %s", line)}
-		}
+// lineLabel names a cart line's item with its modifiers, falling back to the item ID.
+func (m model) lineLabel(l orderLine) string {
+	if it, ok := m.lineItem(l); ok {
+		return it.Name
+	}
+	return l.ItemID
+}
 
-		var items []menuItem
-		if err := json.Unmarshal([]byte(line), &items); err != nil {
-			return menuLoadedMsg{err: fmt.Errorf("invalid menu JSON: %w", err)}
-		}
-		return menuLoadedMsg{items: items}
+// buildForm constructs a fresh order form with an empty cart.
+func (m *model) buildForm() *huh.Form {
+	m.formFields.name = m.defaultName
+	if p := m.formFields.prefill; p != nil {
+		m.formFields.name = p.Name
 	}
+	m.formFields.cart = nil
+	return m.nextItemForm()
 }
 
-// submitOrderCmd sends the order over TCP.
-// Protocol (proposed):
-// - client: "ORDER <json>\n"
-// - server: a single line acknowledgement (freeform), e.g. "OK\n"
-func submitOrderCmd(conn net.Conn, ord order, reader *bufio.Reader) tea.Cmd {
-	return func() tea.Msg {
-		if conn == nil || reader == nil {
-			return orderSubmittedMsg{err: errors.New("not connected")}
-		}
-		b, err := json.Marshal(ord)
-		if err != nil {
-			return orderSubmittedMsg{err: fmt.Errorf("marshal order: %w", err)}
+// quickOrder submits the favorite, or opens the form pre-filled with it if
+// the menu no longer allows placing it as is.
+func (m *model) quickOrder() tea.Cmd {
+	fav := *m.favorite
+	var reason string
+	item, ok := menuItem{}, false
+	for _, it := range m.menu {
+		if it.ID == fav.ItemID {
+			item, ok = it, true
 		}
+	}
+	switch {
+	case !ok:
+		reason = "is no longer on the menu"
+	case item.soldOut():
+		reason = "is sold out"
+	case len(item.Modifiers) > 0:
+		reason = "now has options to choose"
+	case m.maxQuantity > 0 && fav.Quantity > float64(m.maxQuantity):
+		reason = fmt.Sprintf("is limited to %d per order", m.maxQuantity)
+	}
+	if reason != "" {
+		m.status = fmt.Sprintf("Favorite %s %s; check the order.", orDefault(item.Name, fav.ItemID), reason)
+		m.formFields.prefill = &fav
+		m.form = m.buildForm()
+		return m.form.Init()
+	}
 
-		if _, err := fmt.Fprintf(conn, "ORDER %s\n", string(b)); err != nil {
-			return orderSubmittedMsg{err: fmt.Errorf("send ORDER: %w", err)}
-		}
+	ord := newOrder(fav.Name, []orderLine{{ItemID: fav.ItemID, Quantity: fav.Quantity}})
+	return m.sendOrder(ord, fmt.Sprintf("Submitting favorite: %s × %s...", formatQuantity(fav.Quantity, item.Unit), item.Name))
+}
 
-		time.Sleep(150 * time.Millisecond)
+// sendOrder submits ord, showing status until it is answered. The order gets
+// its nonce here, so a retry of lastOrder is recognized by the server.
+func (m *model) sendOrder(ord order, status string) tea.Cmd {
+	if ord.Nonce == "" {
+		ord.Nonce, _ = gonanoid.Generate(idAlphabet, 16)
+	}
+	m.lastOrder = &ord
+	m.retryable, m.orderRetries = false, 0
+	m.lastOrderID = ""
+	m.lastStatus = ""
+	m.lastSubtotal, m.lastTax, m.lastDiscount, m.lastTip, m.lastTotal = 0, 0, 0, 0, 0
+	m.loading = true
+	m.pauseBroadcast = true
+	m.myName = ord.Name
+	m.status = status
+	return tea.Batch(submitOrderV2Cmd(m.conn, ord, m.reader), m.spinner.Tick)
+}
 
-		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
-		defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+// sendChat sends the chat input's line to the room and clears the input for
+// the next one. The line comes back as a broadcast like anyone else's.
+func (m *model) sendChat() tea.Cmd {
+	text := strings.TrimSpace(m.chatInput.Value())
+	switch {
+	case text == "":
+		return nil
+	case m.conn == nil:
+		m.chatErr = fmt.Sprintf("not connected; press esc, then '%s' to reconnect", m.keys.Reconnect)
+		return nil
+	case serverCommand(text):
+		m.chatErr = "that is a server command, not chat"
+		return nil
+	}
+	m.chatInput.Reset()
+	m.chatErr = ""
+	return sendLineCmd(m.conn, text)
+}
 
-		var line string
-		for {
-			l, err := reader.ReadString('\n')
-			if err != nil {
-				return orderSubmittedMsg{err: fmt.Errorf("read ORDER ack: %w", err)}
-			}
-			l = strings.TrimRight(l, "\r\n")
-			if strings.HasPrefix(l, "[join]") || strings.HasPrefix(l, "[leave]") || strings.HasPrefix(l, "[rename]") || strings.HasPrefix(l, "[order]") {
-				continue
-			}
-			line = l
-			break
+// serverCommand reports whether the server would take line as a command
+// rather than chat. Of the slash commands, only /me and /msg are chat.
+func serverCommand(line string) bool {
+	if strings.HasPrefix(line, "/") {
+		return !strings.HasPrefix(line, "/me ") && !strings.HasPrefix(line, "/msg ")
+	}
+	for _, verb := range []string{"PONG", "MENU", "TOTALS", "STATS"} {
+		if strings.EqualFold(line, verb) {
+			return true
 		}
-
-		parts := strings.Split(line, "|")
-		ack := parts[0]
-		var total float64
-		if len(parts) > 1 {
-			if t, err := strconv.ParseFloat(parts[1], 64); err == nil {
-				total = t
-			}
+	}
+	for _, prefix := range []string{"ORDER", "ITEM ", "REPLAY ", "HISTORY ", "STATUS ", "ADDITEM ", "DELITEM ", "SETPRICE "} {
+		if strings.HasPrefix(line, prefix) {
+			return true
 		}
-		return orderSubmittedMsg{ack: ack, total: total}
 	}
+	return line == "PING" || line == "HISTORY"
 }
 
-func listenForBroadcastsCmd(conn net.Conn, reader *bufio.Reader) tea.Cmd {
-	return func() tea.Msg {
-		defer func() {
-			if r := recover(); r != nil {
-				return
-			}
-		}()
-		if conn == nil || reader == nil {
-			return nil
-		}
-
-		_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
-		line, err := reader.ReadString('\n')
-		_ = conn.SetReadDeadline(time.Time{})
-
+// submitOrderBar submits the order bar's input, or keeps the bar open with
+// the problem shown under it.
+func (m *model) submitOrderBar() tea.Cmd {
+	if m.loading {
+		m.orderBarErr = "still busy, try again in a moment"
+		return nil
+	}
+	ord, item, err := m.parseOrderBar(m.orderBar.Value())
+	if err != nil {
+		m.orderBarErr = err.Error()
+		return nil
+	}
+	if m.conn == nil {
+		m.orderBarErr = fmt.Sprintf("not connected; press esc, then '%s' to reconnect", m.keys.Reconnect)
+		return nil
+	}
+	m.orderBar, m.orderBarErr = nil, ""
+	m.err, m.serverError = nil, ""
+	l := ord.lines()[0]
+	return m.sendOrder(ord, fmt.Sprintf("Submitting order: %s × %s...", formatQuantity(l.Quantity, item.Unit), item.Name))
+}
+
+// parseOrderBar parses "name,itemId,qty" into a single-item order, applying
+// the order form's checks.
+func (m *model) parseOrderBar(s string) (order, menuItem, error) {
+	fields := strings.Split(s, ",")
+	if len(fields) != 3 {
+		return order{}, menuItem{}, errors.New("enter name,itemId,qty, e.g. Jane,latte,2")
+	}
+	name := strings.TrimSpace(fields[0])
+	if err := validateCustomerName(name); err != nil {
+		return order{}, menuItem{}, fmt.Errorf("name: %w", err)
+	}
+	id := strings.TrimSpace(fields[1])
+	idx := slices.IndexFunc(m.menu, func(it menuItem) bool { return strings.EqualFold(it.ID, id) })
+	if idx < 0 {
+		return order{}, menuItem{}, fmt.Errorf("item: no %q on the menu", id)
+	}
+	item := m.menu[idx]
+	switch {
+	case item.soldOut():
+		return order{}, menuItem{}, fmt.Errorf("item: %s is sold out", item.Name)
+	case len(item.Modifiers) > 0:
+		return order{}, menuItem{}, fmt.Errorf("item: %s has options, use the order form ('%s')", item.Name, m.keys.NewOrder)
+	}
+	qty, err := parseItemQuantity(fields[2], item.fractional())
+	switch {
+	case err != nil:
+		return order{}, menuItem{}, fmt.Errorf("quantity: %w", err)
+	case m.maxQuantity > 0 && qty > float64(m.maxQuantity):
+		return order{}, menuItem{}, fmt.Errorf("quantity: at most %d per order", m.maxQuantity)
+	case item.Stock != nil && qty > *item.Stock:
+		return order{}, menuItem{}, fmt.Errorf("quantity: only %s left", formatQuantity(*item.Stock, item.Unit))
+	}
+	return newOrder(name, []orderLine{{ItemID: item.ID, Quantity: qty}}), item, nil
+}
+
+// validateCustomerName applies the server's username rules to the order
+// form's name, so a name is not silently shortened or altered.
+func validateCustomerName(s string) error {
+	s = strings.TrimSpace(s)
+	switch {
+	case s == "":
+		return errors.New("name is required")
+	case utf8.RuneCountInString(s) > maxUsernameLen:
+		return fmt.Errorf("at most %d characters", maxUsernameLen)
+	case sanitizeUsername(s) != strings.ReplaceAll(s, " ", "_"):
+		return errors.New("use letters, digits, spaces, '_', '-' or '.' (not at the ends)")
+	}
+	return nil
+}
+
+// menuCategories returns the menu's categories sorted alphabetically, with
+// uncategorized items ("") last. It returns nil if no item has a category.
+func (m *model) menuCategories() []string {
+	seen := map[string]bool{}
+	var cats []string
+	uncategorized := false
+	for _, it := range m.menu {
+		if it.Category == "" {
+			uncategorized = true
+			continue
+		}
+		if !seen[it.Category] {
+			seen[it.Category] = true
+			cats = append(cats, it.Category)
+		}
+	}
+	if len(cats) == 0 {
+		return nil
+	}
+	sort.Strings(cats)
+	if uncategorized {
+		cats = append(cats, "")
+	}
+	return cats
+}
+
+// maxOptionName is the widest item name in the menu list; longer names are
+// cut with an ellipsis.
+const maxOptionName = 24
+
+// outOfStock describes the order's items the menu no longer has enough of,
+// e.g. "Latte sold out" or "Apple has only 0.5 kg left".
+func (m model) outOfStock(ord order) []string {
+	wanted := map[string]float64{}
+	var ids []string
+	for _, l := range ord.lines() {
+		id := strings.ToLower(l.ItemID)
+		if _, ok := wanted[id]; !ok {
+			ids = append(ids, id)
+		}
+		wanted[id] += l.Quantity
+	}
+	var out []string
+	for _, id := range ids {
+		for _, it := range m.menu {
+			if strings.ToLower(it.ID) != id {
+				continue
+			}
+			switch {
+			case it.soldOut():
+				out = append(out, it.Name+" sold out")
+			case it.Stock != nil && *it.Stock < wanted[id]:
+				out = append(out, fmt.Sprintf("%s has only %s left", it.Name, formatQuantity(*it.Stock, it.Unit)))
+			}
+		}
+	}
+	return out
+}
+
+// menuOptions builds select options for items as a name column and a
+// right-aligned price column, marking sold-out ones. Column widths come from
+// the whole menu so every category lines up alike.
+func (m *model) menuOptions(items []menuItem) []huh.Option[string] {
+	nameW, priceW := 0, 0
+	for _, it := range m.menu {
+		nameW = max(nameW, min(lipgloss.Width(it.Name), maxOptionName))
+		priceW = max(priceW, len(unitPrice(it)))
+	}
+	priceStyle := lipgloss.NewStyle().Foreground(m.colors.Price)
+	opts := make([]huh.Option[string], 0, len(items))
+	for _, it := range items {
+		name := truncate(it.Name, maxOptionName)
+		price := fmt.Sprintf("%*s", priceW, unitPrice(it))
+		label := name + strings.Repeat(" ", nameW-lipgloss.Width(name)+2) + priceStyle.Render(price)
+		if it.soldOut() {
+			label += " (sold out)"
+		}
+		opts = append(opts, huh.NewOption(label, it.ID))
+	}
+	return opts
+}
+
+// unitPrice renders an item's price, per unit for items sold by measure,
+// e.g. "$4.50" or "$3.20/kg".
+func unitPrice(it menuItem) string {
+	if it.fractional() {
+		return fmt.Sprintf("$%.2f/%s", it.Price, it.Unit)
+	}
+	return fmt.Sprintf("$%.2f", it.Price)
+}
+
+// truncate shortens s to at most w cells, ending it with an ellipsis.
+func truncate(s string, w int) string {
+	if lipgloss.Width(s) <= w {
+		return s
+	}
+	r := []rune(s)
+	for len(r) > 0 && lipgloss.Width(string(r)) > w-1 {
+		r = r[:len(r)-1]
+	}
+	return string(r) + "…"
+}
+
+// categoryItems returns the items in category, cheapest first.
+func (m *model) categoryItems(category string) []menuItem {
+	var items []menuItem
+	for _, it := range m.menu {
+		if it.Category == category {
+			items = append(items, it)
+		}
+	}
+	sort.SliceStable(items, func(i, j int) bool { return items[i].Price < items[j].Price })
+	return items
+}
+
+// nextItemForm constructs the form for the next cart item:
+// Input (name, first item only) -> Select (category, if any) -> Select (menu) -> Input (qty) -> Confirm (add more)
+// -> Select (tip) -> Input (flat tip, if chosen) -> Confirm (place).
+func (m *model) nextItemForm() *huh.Form {
+	// Reset bound item fields; name and cart carry over between items
+	m.formFields.itemID = ""
+	m.formFields.quantityStr = ""
+	m.formFields.addMore = false
+	m.formFields.confirm = false
+	m.formFields.tipChoice = ""
+	m.formFields.tipFlatStr = ""
+	m.formFields.coupon = ""
+	var prefillCategory *string
+	if p := m.formFields.prefill; p != nil {
+		m.formFields.prefill = nil
+		m.formFields.quantityStr = strconv.FormatFloat(p.Quantity, 'f', -1, 64)
+		for _, it := range m.menu {
+			if it.ID == p.ItemID {
+				m.formFields.itemID = it.ID
+				prefillCategory = &it.Category
+			}
+		}
+	}
+
+	var first []huh.Field
+	if len(m.formFields.cart) == 0 {
+		first = append(first, huh.NewInput().
+			Title("Your name").
+			Prompt("> ").
+			Placeholder("Jane Doe").
+			Value(&m.formFields.name).
+			Validate(validateCustomerName))
+	} else {
+		cart := make([]string, 0, len(m.formFields.cart))
+		for _, l := range m.formFields.cart {
+			cart = append(cart, fmt.Sprintf("%s × %s", m.lineQuantity(l), m.lineLabel(l)))
+		}
+		first = append(first, huh.NewNote().
+			Title("In your order").
+			Description(strings.Join(cart, "\n")))
+	}
+	// Filtering (huh's "/" key) matches option labels case-insensitively,
+	// so typing part of an item's name narrows the list.
+	const filterHint = "Press / to filter by name"
+	items := huh.NewSelect[string]().
+		Title("Menu item")
+	if cats := m.menuCategories(); cats != nil {
+		catOpts := make([]huh.Option[string], 0, len(cats))
+		for _, c := range cats {
+			label := c
+			if c == "" {
+				label = "Other"
+			}
+			catOpts = append(catOpts, huh.NewOption(label, c))
+		}
+		m.formFields.category = cats[0]
+		if prefillCategory != nil {
+			m.formFields.category = *prefillCategory
+		}
+		first = append(first, huh.NewSelect[string]().
+			Title("Category").
+			Options(catOpts...).
+			Value(&m.formFields.category))
+		items.OptionsFunc(func() []huh.Option[string] {
+			return m.menuOptions(m.categoryItems(m.formFields.category))
+		}, &m.formFields.category)
+	} else {
+		items.Options(m.menuOptions(m.menu)...)
+	}
+	first = append(first, items.
+		Value(&m.formFields.itemID).
+		// The chosen item's description goes above the filter hint.
+		DescriptionFunc(func() string {
+			for _, it := range m.menu {
+				if it.ID == m.formFields.itemID && it.Description != "" {
+					return it.Description + "\n" + filterHint
+				}
+			}
+			return filterHint
+		}, &m.formFields.itemID).
+		Validate(func(v string) error {
+			if v == "" {
+				return errors.New("please select a menu item")
+			}
+			for _, it := range m.menu {
+				if it.ID == v && it.soldOut() {
+					return errors.New("that item is sold out")
+				}
+			}
+			return nil
+		}))
+
+	groups := append([]*huh.Group{huh.NewGroup(first...)}, m.modifierGroups()...)
+	groups = append(groups,
+		huh.NewGroup(
+			&quantityStepper{
+				Input: huh.NewInput().
+					Title("Quantity").
+					Description("↑/↓ to step").
+					Prompt("> ").
+					Placeholder("1").
+					Value(&m.formFields.quantityStr).
+					Validate(func(s string) error {
+						n, err := m.parseQuantity(s)
+						if err != nil {
+							return err
+						}
+						if m.maxQuantity > 0 && n > float64(m.maxQuantity) {
+							return fmt.Errorf("at most %d per item", m.maxQuantity)
+						}
+						return nil
+					}),
+				value: &m.formFields.quantityStr,
+				limit: m.quantityLimit,
+			},
+			huh.NewConfirm().
+				Title("Add another item?").
+				Affirmative("Yes").
+				Negative("No").
+				Value(&m.formFields.addMore),
+		),
+		huh.NewGroup(
+			huh.NewSelect[string]().
+				Title("Tip").
+				Options(
+					huh.NewOption("No tip", ""),
+					huh.NewOption("10%", "10"),
+					huh.NewOption("15%", "15"),
+					huh.NewOption("20%", "20"),
+					huh.NewOption("Flat amount", tipFlat),
+				).
+				Value(&m.formFields.tipChoice),
+			huh.NewInput().
+				Title("Coupon code (optional)").
+				Prompt("> ").
+				Value(&m.formFields.coupon),
+		).WithHideFunc(func() bool { return m.formFields.addMore }),
+		huh.NewGroup(
+			huh.NewInput().
+				Title("Tip amount").
+				Prompt("$ ").
+				Placeholder("1.00").
+				Value(&m.formFields.tipFlatStr).
+				Validate(func(s string) error {
+					v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+					if err != nil || v < 0 {
+						return errors.New("enter a non-negative amount")
+					}
+					return nil
+				}),
+		).WithHideFunc(func() bool { return m.formFields.addMore || m.formFields.tipChoice != tipFlat }),
+		huh.NewGroup(
+			huh.NewConfirm().
+				TitleFunc(func() string {
+					if strings.TrimSpace(m.formFields.coupon) != "" {
+						return fmt.Sprintf("Place order? (Total: $%.2f before tax and coupon)", m.previewTotal())
+					}
+					return fmt.Sprintf("Place order? (Total: $%.2f before tax)", m.previewTotal())
+				}, []any{&m.formFields.itemID, &m.formFields.quantityStr, &m.formFields.tipChoice, &m.formFields.tipFlatStr, &m.formFields.coupon, m.formFields.modSingle, m.formFields.modMulti}).
+				Affirmative("Yes").
+				Negative("No").
+				Value(&m.formFields.confirm),
+		).WithHideFunc(func() bool { return m.formFields.addMore }),
+	)
+
+	return huh.NewForm(groups...).WithTheme(huh.ThemeBase())
+}
+
+// quantityLimit is the most of the chosen item the form can step up to: the
+// quantity cap, or the stock left after the cart, whichever is lower. The
+// stock left is returned as is, so it may be zero or less once the cart
+// holds all of it. ok is false when there is no limit.
+func (m *model) quantityLimit() (limit float64, ok bool) {
+	limit, ok = float64(m.maxQuantity), m.maxQuantity > 0
+	for _, it := range m.menu {
+		if it.ID != m.formFields.itemID || it.Stock == nil {
+			continue
+		}
+		left := *it.Stock
+		for _, l := range m.formFields.cart {
+			if l.ItemID == it.ID {
+				left -= l.Quantity
+			}
+		}
+		if !ok || left < limit {
+			limit, ok = left, true
+		}
+	}
+	return limit, ok
+}
+
+// quantityStepper is a quantity input whose up and down keys step the number
+// between 1 and limit(), and do nothing when the limit is below 1; typing
+// still works and is validated as usual.
+type quantityStepper struct {
+	*huh.Input
+	value *string
+	limit func() (float64, bool)
+}
+
+func (q *quantityStepper) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	if km, ok := msg.(tea.KeyMsg); ok && (km.String() == "up" || km.String() == "down") {
+		limit, limited := q.limit()
+		if limited && limit <= 0 {
+			return q, nil
+		}
+		n, err := strconv.ParseFloat(strings.TrimSpace(*q.value), 64)
+		switch {
+		case err != nil || n < 1:
+			n = 1
+		case km.String() == "up":
+			n++
+		default:
+			n = max(n-1, 1)
+		}
+		if limited {
+			n = min(n, limit)
+		}
+		*q.value = strconv.FormatFloat(n, 'f', -1, 64)
+		// Rebinding the value refreshes the text shown.
+		q.Input.Value(q.value)
+		return q, nil
+	}
+	_, cmd := q.Input.Update(msg)
+	return q, cmd
+}
+
+// itemModifiers returns the modifier groups of the menu item with the given ID.
+func (m *model) itemModifiers(id string) []modifierGroup {
+	for _, it := range m.menu {
+		if it.ID == id {
+			return it.Modifiers
+		}
+	}
+	return nil
+}
+
+// modifierGroups builds two form groups per modifier slot, as many slots as
+// the menu item with the most modifiers has. Each shows the chosen item's
+// modifier group at that index, as a select or (for Multi groups) a
+// multi-select, and hides when the item has no such group.
+func (m *model) modifierGroups() []*huh.Group {
+	n := 0
+	for _, it := range m.menu {
+		n = max(n, len(it.Modifiers))
+	}
+	m.formFields.modSingle = make([]string, n)
+	m.formFields.modMulti = make([][]string, n)
+
+	var groups []*huh.Group
+	for i := range n {
+		slot := func() (modifierGroup, bool) {
+			mods := m.itemModifiers(m.formFields.itemID)
+			if i >= len(mods) {
+				return modifierGroup{}, false
+			}
+			return mods[i], true
+		}
+		title := func() string {
+			g, _ := slot()
+			return g.Name
+		}
+		options := func() []huh.Option[string] {
+			g, _ := slot()
+			return modifierOptions(g)
+		}
+		groups = append(groups,
+			huh.NewGroup(huh.NewSelect[string]().
+				TitleFunc(title, &m.formFields.itemID).
+				OptionsFunc(options, &m.formFields.itemID).
+				Value(&m.formFields.modSingle[i]),
+			).WithHideFunc(func() bool {
+				g, ok := slot()
+				return !ok || g.Multi
+			}),
+			huh.NewGroup(huh.NewMultiSelect[string]().
+				TitleFunc(title, &m.formFields.itemID).
+				OptionsFunc(options, &m.formFields.itemID).
+				Value(&m.formFields.modMulti[i]),
+			).WithHideFunc(func() bool {
+				g, ok := slot()
+				return !ok || !g.Multi
+			}),
+		)
+	}
+	return groups
+}
+
+// modifierOptions labels a modifier group's choices with their price deltas.
+func modifierOptions(g modifierGroup) []huh.Option[string] {
+	opts := make([]huh.Option[string], 0, len(g.Choices))
+	for _, c := range g.Choices {
+		label := c.Name
+		switch {
+		case c.Price > 0:
+			label += fmt.Sprintf(" (+$%.2f)", c.Price)
+		case c.Price < 0:
+			label += fmt.Sprintf(" (-$%.2f)", -c.Price)
+		}
+		opts = append(opts, huh.NewOption(label, c.Name))
+	}
+	return opts
+}
+
+// selectedModifiers collects the form's modifier choices for the chosen item.
+// Choices left over from a previously chosen item are dropped.
+func (m *model) selectedModifiers() map[string][]string {
+	var sel map[string][]string
+	for i, g := range m.itemModifiers(m.formFields.itemID) {
+		names := []string{m.formFields.modSingle[i]}
+		if g.Multi {
+			names = m.formFields.modMulti[i]
+		}
+		for _, name := range names {
+			if !slices.ContainsFunc(g.Choices, func(c modifierChoice) bool { return c.Name == name }) {
+				continue
+			}
+			if sel == nil {
+				sel = map[string][]string{}
+			}
+			sel[g.Name] = append(sel[g.Name], name)
+		}
+	}
+	return sel
+}
+
+// previewTotal estimates the order total, before tax, from the cached menu:
+// the cart plus the item being added, plus the chosen tip. The server's ack
+// remains the authoritative total.
+func (m *model) previewTotal() float64 {
+	lines := append([]orderLine(nil), m.formFields.cart...)
+	if qty, err := m.parseQuantity(m.formFields.quantityStr); err == nil {
+		lines = append(lines, orderLine{ItemID: m.formFields.itemID, Quantity: qty, Modifiers: m.selectedModifiers()})
+	}
+	var subtotal float64
+	for _, l := range lines {
+		for _, it := range m.menu {
+			if it.ID == l.ItemID {
+				it, _ = it.withModifiers(l.Modifiers)
+				subtotal += l.Quantity * it.Price
+				break
+			}
+		}
+	}
+	var o order
+	m.formFields.applyTip(&o)
+	tip := o.TipAmount
+	if o.TipPercent > 0 {
+		tip = subtotal * o.TipPercent / 100
+	}
+	return roundCents(subtotal + tip)
+}
+
+// savedOrder is one line of the local order log.
+type savedOrder struct {
+	OrderID  string      `json:"orderId,omitempty"`
+	Name     string      `json:"name"`
+	Items    []savedItem `json:"items"`
+	Subtotal float64     `json:"subtotal,omitempty"`
+	Tax      float64     `json:"tax,omitempty"`
+	Discount float64     `json:"discount,omitempty"`
+	Tip      float64     `json:"tip,omitempty"`
+	Total    float64     `json:"total"`
+	SavedAt  time.Time   `json:"savedAt"`
+}
+
+type savedItem struct {
+	ItemID   string  `json:"itemId"`
+	Item     string  `json:"item"`
+	Quantity float64 `json:"quantity"`
+	Unit     string  `json:"unit,omitempty"`
+	// Price is the unit price including modifiers, from the cached menu.
+	Price float64 `json:"price,omitempty"`
+}
+
+// receipt describes the last submitted order with item labels resolved.
+func (m model) receipt() savedOrder {
+	rec := savedOrder{
+		OrderID:  m.lastOrderID,
+		Name:     m.lastOrder.Name,
+		Subtotal: m.lastSubtotal,
+		Tax:      m.lastTax,
+		Discount: m.lastDiscount,
+		Tip:      m.lastTip,
+		Total:    m.lastTotal,
+		SavedAt:  time.Now(),
+	}
+	for _, l := range m.lastOrder.lines() {
+		it, _ := m.lineItem(l)
+		rec.Items = append(rec.Items, savedItem{ItemID: l.ItemID, Item: m.lineLabel(l), Quantity: l.Quantity, Unit: it.Unit, Price: it.Price})
+	}
+	return rec
+}
+
+// defaultConfigFile returns ~/.clink/config.json, or a relative path if the
+// home directory is unknown.
+func defaultConfigFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "config.json"
+	}
+	return filepath.Join(home, ".clink", "config.json")
+}
+
+// defaultOrdersFile returns ~/.clink/orders.jsonl, or a relative path if the
+// home directory is unknown.
+func defaultOrdersFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "orders.jsonl"
+	}
+	return filepath.Join(home, ".clink", "orders.jsonl")
+}
+
+// saveOrderCmd appends the order as a JSON line to path.
+func saveOrderCmd(path string, rec savedOrder) tea.Cmd {
+	return func() tea.Msg {
+		b, err := json.Marshal(rec)
+		if err != nil {
+			return statusMsg(fmt.Sprintf("Save failed: %v", err))
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return statusMsg(fmt.Sprintf("Save failed: %v", err))
+		}
+		f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+		if err != nil {
+			return statusMsg(fmt.Sprintf("Save failed: %v", err))
+		}
+		defer f.Close()
+		if _, err := f.Write(append(b, '\n')); err != nil {
+			return statusMsg(fmt.Sprintf("Save failed: %v", err))
+		}
+		return statusMsg(fmt.Sprintf("Order saved to %s", path))
+	}
+}
+
+// saveFavoriteCmd stores fav in the config file at path, keeping its other
+// settings.
+func saveFavoriteCmd(path string, fav favorite) tea.Cmd {
+	return func() tea.Msg {
+		settings := map[string]json.RawMessage{}
+		b, err := os.ReadFile(path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return statusMsg(fmt.Sprintf("Save favorite failed: %v", err))
+		}
+		if len(b) > 0 {
+			if err := json.Unmarshal(b, &settings); err != nil {
+				return statusMsg(fmt.Sprintf("Save favorite failed: parse %s: %v", path, err))
+			}
+		}
+		if settings["favorite"], err = json.Marshal(fav); err != nil {
+			return statusMsg(fmt.Sprintf("Save favorite failed: %v", err))
+		}
+		if b, err = json.MarshalIndent(settings, "", "  "); err != nil {
+			return statusMsg(fmt.Sprintf("Save favorite failed: %v", err))
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return statusMsg(fmt.Sprintf("Save favorite failed: %v", err))
+		}
+		if err := os.WriteFile(path, append(b, '\n'), 0o644); err != nil {
+			return statusMsg(fmt.Sprintf("Save favorite failed: %v", err))
+		}
+		return statusMsg(fmt.Sprintf("Favorite saved to %s", path))
+	}
+}
+
+// defaultReceiptFile returns ~/.clink/receipt.txt, or a relative path if the
+// home directory is unknown.
+func defaultReceiptFile() string {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "receipt.txt"
+	}
+	return filepath.Join(home, ".clink", "receipt.txt")
+}
+
+// formatReceipt renders the session's orders as a plain-text receipt.
+func formatReceipt(orders []savedOrder, at time.Time) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Clink receipt\n%s\n", at.Format("2006-01-02 15:04"))
+	var grand float64
+	for _, o := range orders {
+		b.WriteString("\n")
+		b.WriteString(formatOrder(o))
+		grand += o.Total
+	}
+	b.WriteString("\n")
+	fmt.Fprintf(&b, "%-36s %9s\n", "Grand total", fmt.Sprintf("$%.2f", grand))
+	return b.String()
+}
+
+// formatOrder renders one order as plain text: its items, any adjustments
+// and its total.
+func formatOrder(o savedOrder) string {
+	var b strings.Builder
+	row := func(label string, amount float64) {
+		amt := fmt.Sprintf("$%.2f", amount)
+		if amount < 0 {
+			amt = fmt.Sprintf("-$%.2f", -amount)
+		}
+		fmt.Fprintf(&b, "  %-34s %9s\n", label, amt)
+	}
+	fmt.Fprintf(&b, "Order %s for %s, %s\n", orDefault(o.OrderID, "-"), o.Name, o.SavedAt.Format("15:04"))
+	for _, it := range o.Items {
+		row(fmt.Sprintf("%s × %s", formatQuantity(it.Quantity, it.Unit), it.Item), it.Quantity*it.Price)
+	}
+	if o.Tax > 0 || o.Discount > 0 || o.Tip > 0 {
+		row("Subtotal", o.Subtotal)
+	}
+	if o.Discount > 0 {
+		row("Discount", -o.Discount)
+	}
+	if o.Tax > 0 {
+		row("Tax", o.Tax)
+	}
+	if o.Tip > 0 {
+		row("Tip", o.Tip)
+	}
+	row("Total", o.Total)
+	return b.String()
+}
+
+// copiedStatus is shown briefly after the last order is copied.
+const copiedStatus = "Copied to clipboard"
+
+// copyOrderCmd copies a plain-text summary of o to the system clipboard.
+func copyOrderCmd(o savedOrder) tea.Cmd {
+	return func() tea.Msg {
+		if err := clipboard.WriteAll(formatOrder(o)); err != nil {
+			return statusMsg(fmt.Sprintf("Copy failed: %v", err))
+		}
+		return statusMsg(copiedStatus)
+	}
+}
+
+// writeReceiptCmd writes a receipt of the session's orders to path, replacing it.
+func writeReceiptCmd(path string, orders []savedOrder) tea.Cmd {
+	return func() tea.Msg {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return statusMsg(fmt.Sprintf("Receipt failed: %v", err))
+		}
+		if err := os.WriteFile(path, []byte(formatReceipt(orders, time.Now())), 0o644); err != nil {
+			return statusMsg(fmt.Sprintf("Receipt failed: %v", err))
+		}
+		return statusMsg(fmt.Sprintf("Receipt written to %s", path))
+	}
+}
+
+// connectCmd connects to the TCP server, over TLS when tlsConfig is set, and
+// consumes the two greeting lines so they are never mistaken for a response.
+// Unless room is the server's default, it then joins room. After a reconnect,
+// since is the last broadcast seen, and whatever the server still has after
+// it is replayed.
+func connectCmd(addr string, tlsConfig *tls.Config, room string, since uint64, timeout time.Duration) tea.Cmd {
+	return func() tea.Msg {
+		start := time.Now()
+		conn, reader, id, err := dialServer(addr, tlsConfig, room, timeout)
 		if err != nil {
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				return statusMsg(fmt.Sprintf("Connect failed: no answer from %s after %s.", addr, time.Since(start).Round(100*time.Millisecond)))
+			}
+			return statusMsg(fmt.Sprintf("Connect failed: %v", err))
+		}
+		var (
+			replay    []string
+			restarted bool
+		)
+		if since > 0 {
+			replay, restarted = replayBroadcasts(conn, reader, since)
+		}
+		_ = conn.SetReadDeadline(time.Time{})
+
+		return connectedMsg{conn: conn, reader: reader, id: id, replay: replay, restarted: restarted}
+	}
+}
+
+// dialServer connects to addr, reads the greeting and joins room unless it
+// is the server's default. It returns the connection's id from the welcome line.
+func dialServer(addr string, tlsConfig *tls.Config, room string, timeout time.Duration) (net.Conn, *connReader, string, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if tlsConfig != nil {
+		conn, err = tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = net.DialTimeout("tcp", addr, timeout)
+	}
+	if err != nil {
+		return nil, nil, "", err
+	}
+
+	reader := &connReader{Reader: bufio.NewReader(conn)}
+	_ = conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	var id string
+	for i := 0; i < 2; i++ {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		// "Welcome <username> (<id>)"
+		if i == 0 {
+			if _, rest, ok := strings.Cut(line, "("); ok {
+				id, _, _ = strings.Cut(rest, ")")
+			}
+		}
+	}
+	if room != "" && room != defaultRoom {
+		if err := joinRoom(conn, reader, room); err != nil {
+			_ = conn.Close()
+			return nil, nil, "", err
+		}
+	}
+	_ = conn.SetReadDeadline(time.Time{})
+	return conn, reader, id, nil
+}
+
+// joinRoom sends /join and waits for the server to confirm it. The lobby's
+// replayed orders and other broadcasts that arrive first are dropped.
+func joinRoom(conn net.Conn, reader *connReader, room string) error {
+	if _, err := fmt.Fprintf(conn, "/join %s\n", room); err != nil {
+		return fmt.Errorf("join room: %w", err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("join room: %w", err)
+		}
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[info] joined room ") || strings.HasPrefix(line, "[info] already in room ") {
+			return nil
+		}
+		if msg, ok := strings.CutPrefix(line, "[error] "); ok {
+			return fmt.Errorf("join room %s: %s", room, msg)
+		}
+	}
+}
+
+// replayBroadcasts sends REPLAY and collects the numbered broadcasts that
+// arrive until the server's count, sorted by sequence. Besides the replay
+// itself they include the room's recent orders and live broadcasts, which
+// may repeat replayed ones. A failed replay just returns what was read.
+// restarted reports that the server's latest broadcast is numbered below
+// since, so the server restarted and its numbers start over.
+func replayBroadcasts(conn net.Conn, reader *connReader, since uint64) (lines []string, restarted bool) {
+	if _, err := fmt.Fprintf(conn, "REPLAY %d\n", since); err != nil {
+		return nil, false
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			break
+		}
+		line = strings.TrimRight(line, "\r\n")
+		if count, ok := strings.CutPrefix(line, "[info] replayed "); ok {
+			// Older servers send only the count.
+			var n, latest uint64
+			if _, err := fmt.Sscanf(count, "%d, latest #%d", &n, &latest); err == nil {
+				restarted = latest < since
+			}
+			break
+		}
+		if strings.HasPrefix(line, "[error] ") {
+			break
+		}
+		if line == "PING" {
+			_, _ = fmt.Fprintln(conn, "PONG")
+			continue
+		}
+		if seq, _ := splitSeq(line); seq > 0 {
+			lines = append(lines, line)
+		}
+	}
+	slices.SortStableFunc(lines, func(a, b string) int {
+		x, _ := splitSeq(a)
+		y, _ := splitSeq(b)
+		return cmp.Compare(x, y)
+	})
+	return lines, restarted
+}
+
+// rejection is an error reply from the server, as opposed to a failure to
+// reach it.
+type rejection string
+
+func (r rejection) Error() string { return string(r) }
+
+// setErr shows err, telling the server's rejection of what (e.g. "order")
+// apart from transport errors.
+func (m *model) setErr(what string, err error) {
+	m.err, m.serverError = nil, ""
+	var r rejection
+	if errors.As(err, &r) {
+		m.serverError = fmt.Sprintf("Server rejected %s: %s", what, r)
+		return
+	}
+	m.err = err
+}
+
+// connReader is the buffered reader of a connection. Menu, order and
+// broadcast commands may run concurrently, so each holds mu from sending its
+// request until it has read the reply.
+type connReader struct {
+	mu sync.Mutex
+	*bufio.Reader
+	// pending is the start of a line that a broadcast poll gave up waiting
+	// for the rest of; the next read finishes it.
+	pending string
+}
+
+// ReadString is bufio.Reader's, except that the line starts with any
+// pending text. The caller holds mu.
+func (r *connReader) ReadString(delim byte) (string, error) {
+	s, err := r.Reader.ReadString(delim)
+	s, r.pending = r.pending+s, ""
+	return s, err
+}
+
+// fetchMenuCmd asks the server for a menu via the TCP connection.
+// Protocol (proposed):
+// - client: "MENU\n"
+// - server: single line JSON array: [{"id":"x","name":"..."}]\n
+func fetchMenuCmd(conn net.Conn, reader *connReader) tea.Cmd {
+	return func() tea.Msg {
+		return fetchMenu(conn, reader)
+	}
+}
+
+// fetchMenu sends MENU and reads the reply, skipping broadcasts and other
+// lines that are not the reply.
+func fetchMenu(conn net.Conn, reader *connReader) menuLoadedMsg {
+	if conn == nil || reader == nil {
+		return menuLoadedMsg{err: errors.New("not connected")}
+	}
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+
+	if _, err := fmt.Fprintln(conn, "MENU"); err != nil {
+		return menuLoadedMsg{err: fmt.Errorf("send MENU: %w", err)}
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+
+	// Anything that is neither a JSON array nor an error, such as a
+	// broadcast or a late reply to another command, is skipped until the
+	// menu arrives or the deadline passes.
+	var line string
+	for {
+		l, err := reader.ReadString('\n')
+		if err != nil {
+			return menuLoadedMsg{err: fmt.Errorf("read MENU: %w", err)}
+		}
+		l = strings.TrimRight(l, "\r\n")
+		if handleAsyncLine(conn, l) {
+			continue
+		}
+		if strings.HasPrefix(l, "[error] ") || strings.HasPrefix(l, "[") && json.Valid([]byte(l)) {
+			line = l
+			break
+		}
+	}
+
+	if msg, ok := strings.CutPrefix(line, "[error] "); ok {
+		if msg == "menu is empty" {
+			return menuLoadedMsg{}
+		}
+		return menuLoadedMsg{err: rejection(msg)}
+	}
+
+	var items []menuItem
+	if err := json.Unmarshal([]byte(line), &items); err != nil {
+		return menuLoadedMsg{err: fmt.Errorf("invalid menu JSON: %w", err)}
+	}
+	return menuLoadedMsg{items: items}
+}
+
+// submitOrderCmd sends the order over TCP.
+// Protocol (proposed):
+// - client: "ORDER <json>\n"
+// - server: a single line acknowledgement, e.g. "OK|<total>|<orderId>\n" (order ID may be absent)
+func submitOrderCmd(conn net.Conn, ord order, reader *connReader) tea.Cmd {
+	return func() tea.Msg {
+		return submitOrder(conn, ord, reader)
+	}
+}
+
+// submitOrder sends ORDER and parses the ack. Rejections come back as a
+// rejection error.
+func submitOrder(conn net.Conn, ord order, reader *connReader) orderSubmittedMsg {
+	if conn == nil || reader == nil {
+		return orderSubmittedMsg{err: errors.New("not connected")}
+	}
+	if ord.Nonce == "" {
+		ord.Nonce, _ = gonanoid.Generate(idAlphabet, 16)
+	}
+	b, err := json.Marshal(ord)
+	if err != nil {
+		return orderSubmittedMsg{err: fmt.Errorf("marshal order: %w", err)}
+	}
+
+	reader.mu.Lock()
+	defer reader.mu.Unlock()
+	line, err := exchangeOrder(conn, reader, "ORDER", b, nil)
+	if err != nil {
+		return orderSubmittedMsg{err: err}
+	}
+
+	if msg, ok := strings.CutPrefix(line, "[error] "); ok {
+		return orderSubmittedMsg{err: rejection(msg)}
+	}
+	parts := strings.Split(line, "|")
+	ack := parts[0]
+	var total float64
+	if len(parts) > 1 {
+		if t, err := strconv.ParseFloat(parts[1], 64); err == nil {
+			total = t
+		}
+	}
+	var orderID string
+	if len(parts) > 2 {
+		orderID = strings.TrimSpace(parts[2])
+	}
+	return orderSubmittedMsg{ack: ack, total: total, orderID: orderID}
+}
+
+// orderAckTimeout is how long an order waits for its ack before it is
+// reported as failed and offered for retry.
+var orderAckTimeout = 5 * time.Second
+
+// exchangeOrder sends "<verb> <payload>" and returns the ack, skipping
+// broadcasts and any line stale reports as an ack for another order. A
+// nil stale takes the first reply. The caller holds reader.mu.
+func exchangeOrder(conn net.Conn, reader *connReader, verb string, payload []byte, stale func(string) bool) (string, error) {
+	if _, err := fmt.Fprintf(conn, "%s %s\n", verb, payload); err != nil {
+		return "", fmt.Errorf("send %s: %w", verb, err)
+	}
+	_ = conn.SetReadDeadline(time.Now().Add(orderAckTimeout))
+	defer func() { _ = conn.SetReadDeadline(time.Time{}) }()
+	for {
+		l, err := reader.ReadString('\n')
+		if err != nil {
+			return "", fmt.Errorf("read %s ack: %w", verb, err)
+		}
+		l = strings.TrimRight(l, "\r\n")
+		if handleAsyncLine(conn, l) || (stale != nil && stale(l)) {
+			continue
+		}
+		return l, nil
+	}
+}
+
+// submitOrderV2Cmd sends the order using the JSON acknowledgement protocol.
+// Protocol:
+// - client: "ORDERV2 <json>\n"
+// - server: {"status":"ok","total":4.50,"orderId":"abc123"} or {"status":"error","message":"..."}
+func submitOrderV2Cmd(conn net.Conn, ord order, reader *connReader) tea.Cmd {
+	return func() tea.Msg {
+		if conn == nil || reader == nil {
+			return orderSubmittedMsg{err: errors.New("not connected")}
+		}
+		if ord.Nonce == "" {
+			ord.Nonce, _ = gonanoid.Generate(idAlphabet, 16)
+		}
+		b, err := json.Marshal(ord)
+		if err != nil {
+			return orderSubmittedMsg{err: fmt.Errorf("marshal order: %w", err)}
+		}
+
+		reader.mu.Lock()
+		defer reader.mu.Unlock()
+		// An ack that timed out may still arrive; it carries its own
+		// order's nonce and is skipped.
+		stale := func(l string) bool {
+			var ack orderAck
+			return isOrderAck(l) && json.Unmarshal([]byte(l), &ack) == nil && ack.Nonce != "" && ack.Nonce != ord.Nonce
+		}
+		line, err := exchangeOrder(conn, reader, "ORDERV2", b, stale)
+		if err != nil {
+			return orderSubmittedMsg{err: err}
+		}
+
+		var ack orderAck
+		if err := json.Unmarshal([]byte(line), &ack); err != nil {
+			return orderSubmittedMsg{err: fmt.Errorf("invalid ORDERV2 ack: %w", err)}
+		}
+		if ack.Status != ackOK {
+			return orderSubmittedMsg{err: rejection(ack.Message)}
+		}
+		return orderSubmittedMsg{ack: ack.Status, subtotal: ack.Subtotal, tax: ack.Tax, discount: ack.Discount, tip: ack.Tip, total: ack.Total, orderID: ack.OrderID}
+	}
+}
+
+// handleAsyncLine reports whether l is an unsolicited server line (a
+// broadcast, heartbeat or latency reply) rather than a response. Heartbeat
+// PINGs are answered with PONG on conn.
+func handleAsyncLine(conn net.Conn, l string) bool {
+	if l == "PING" {
+		_, _ = fmt.Fprintln(conn, "PONG")
+		return true
+	}
+	if l == "PONG" {
+		return true
+	}
+	if seq, _ := splitSeq(l); seq > 0 {
+		return true
+	}
+	return strings.HasPrefix(l, "[join]") || strings.HasPrefix(l, "[leave]") || strings.HasPrefix(l, "[rename]") || strings.HasPrefix(l, "[kick]") || strings.HasPrefix(l, "[order]") || strings.HasPrefix(l, "[pm]") || strings.HasPrefix(l, "[action]") || strings.HasPrefix(l, "[status]") || strings.HasPrefix(l, "[summary]") || strings.HasPrefix(l, "[server]") || strings.HasPrefix(l, "[menu]") || strings.HasPrefix(l, "[info] name set to ") || l == "[error] username taken" || l == "[error] invalid username"
+}
+
+// isOrderAck reports whether l is an ORDERV2 ack.
+func isOrderAck(l string) bool {
+	return strings.HasPrefix(l, `{"status":`)
+}
+
+// readRetries is how many times the broadcast listener retries a transient
+// read error, waiting readRetryDelay longer each time.
+const (
+	readRetries    = 3
+	readRetryDelay = 50 * time.Millisecond
+)
+
+// transientReadError reports whether a read failed for a reason that may
+// clear up by itself, such as an interrupted system call, rather than
+// because the connection is gone.
+func transientReadError(err error) bool {
+	if errors.Is(err, syscall.EINTR) || errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.ENOBUFS) {
+		return true
+	}
+	var t interface{ Temporary() bool }
+	return errors.As(err, &t) && t.Temporary()
+}
+
+func listenForBroadcastsCmd(conn net.Conn, reader *connReader) tea.Cmd {
+	return func() tea.Msg {
+		defer func() {
+			if r := recover(); r != nil {
+				return
+			}
+		}()
+		if conn == nil || reader == nil {
+			return nil
+		}
+		reader.mu.Lock()
+		defer reader.mu.Unlock()
+
+		// Transient errors are retried, keeping any partial line read
+		// so far, before the connection is given up as closed. A line cut
+		// off by the poll timeout is kept for the next poll.
+		var line string
+		for retry := 0; ; retry++ {
+			_ = conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			part, err := reader.ReadString('\n')
+			_ = conn.SetReadDeadline(time.Time{})
+			line += part
+			if err == nil {
+				break
+			}
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
-				return broadcastMsg("")
+				reader.pending = line
+				return broadcastMsg(nil)
+			}
+			if !transientReadError(err) || retry == readRetries {
+				return statusMsg(fmt.Sprintf("Connection closed: %v", err))
 			}
-			return statusMsg(fmt.Sprintf("Connection closed: %v", err))
+			time.Sleep(time.Duration(retry+1) * readRetryDelay)
 		}
-		return broadcastMsg(strings.TrimRight(line, "\r\n"))
+		// Drain any further complete lines that arrived in the same read,
+		// so a burst is handled in one update instead of one per poll.
+		lines := []string{line}
+		for {
+			buffered, _ := reader.Peek(reader.Buffered())
+			if !bytes.Contains(buffered, []byte{'\n'}) {
+				break
+			}
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				reader.pending = line
+				break
+			}
+			lines = append(lines, line)
+		}
+
+		var msg broadcastMsg
+		for _, l := range lines {
+			l = strings.TrimRight(l, "\r\n")
+			if l == "PING" {
+				_, _ = fmt.Fprintln(conn, "PONG")
+				continue
+			}
+			// An ack that arrived after its order timed out is not a
+			// broadcast; retrying the order gets it again.
+			if isOrderAck(l) {
+				continue
+			}
+			msg = append(msg, l)
+		}
+		return msg
 	}
 }
 
+// applyEnv sets each flag in fs from its CLINK_ environment variable, e.g.
+// CLINK_HOST for -host or CLINK_RATE_ORDERS for -rate-orders.
+func applyEnv(fs *flag.FlagSet) error {
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		name := "CLINK_" + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+		v, ok := os.LookupEnv(name)
+		if !ok || err != nil {
+			return
+		}
+		if e := fs.Set(f.Name, v); e != nil {
+			err = fmt.Errorf("%s: %w", name, e)
+		}
+	})
+	return err
+}
+
 func main() {
 	var (
-		host       string
-		serverOnly bool
-		menuJSON   string
+		host        string
+		serverOnly  bool
+		menuSrc     string
+		history     int
+		replaySize  int
+		reconnects  int
+		useTLS      bool
+		certFile    string
+		keyFile     string
+		insecure    bool
+		ordersFile  string
+		receiptFile string
+		feedSize    int
+		heartbeat   time.Duration
+		rateOrders  int
+		rateWindow  time.Duration
+		taxRate     float64
+		logFile     string
+		logMaxSize  int64
+		quiet       bool
+		couponSrc   string
+		happySrc    string
+		dbPath      string
+		configFile  string
+		themeMode   string
+		adminToken  string
+		maxConns    int
+		idle        time.Duration
+		maxChat     int
+		bcastBuffer int
+		summaryIntv time.Duration
+		connTimeout time.Duration
+		readOnly    bool
+		bench       bool
+		benchConns  int
+		benchRate   float64
+		benchDur    time.Duration
+		benchItem   string
+		maxQuantity int
+		greeting    string
+		wsAddr      string
+		wsPath      string
+		wsOrigins   string
+		room        string
+		name        string
+		bannerFile  string
 	)
 	flag.StringVar(&host, "host", "localhost:9000", "host:port to connect to or bind the server on")
 	flag.BoolVar(&serverOnly, "server", false, "run only the server")
-	flag.StringVar(&menuJSON, "menu", "", "JSON array of menu items (server mode only), e.g. '[{\"id\":\"tea\",\"name\":\"Green Tea\",\"price\":2.5}]'")
+	flag.StringVar(&menuSrc, "menu", "", "path to a JSON file with an array of menu items (server mode only); an inline JSON array is also accepted")
+	flag.IntVar(&history, "history", 20, "number of recent orders replayed to newly connected clients (server mode only)")
+	flag.IntVar(&replaySize, "replay-size", 256, "number of recent broadcasts kept for clients catching up with REPLAY after a reconnect (server mode only)")
+	flag.IntVar(&reconnects, "reconnect-max", 10, "maximum automatic reconnect attempts after the connection drops (0 disables)")
+	flag.DurationVar(&connTimeout, "connect-timeout", 3*time.Second, "how long to wait for the server to answer each connection attempt (client only)")
+	flag.BoolVar(&readOnly, "read-only", false, "show only the live order feed, full width, with ordering disabled, e.g. for a wall display (client only)")
+	flag.BoolVar(&bench, "bench", false, "run a headless load test against -host instead of the TUI and print a report (see -bench-*)")
+	flag.IntVar(&benchConns, "bench-clients", 10, "connections placing orders at once (bench mode only)")
+	flag.Float64Var(&benchRate, "bench-rate", 1, "orders per second each bench connection places (bench mode only)")
+	flag.DurationVar(&benchDur, "bench-duration", 10*time.Second, "how long the bench places orders (bench mode only)")
+	flag.StringVar(&benchItem, "bench-item", "", "item ID the bench orders; empty picks the first item in stock (bench mode only)")
+	flag.BoolVar(&useTLS, "tls", false, "use TLS for the connection (server requires -cert and -key)")
+	flag.StringVar(&certFile, "cert", "", "TLS certificate file (server mode only)")
+	flag.StringVar(&keyFile, "key", "", "TLS private key file (server mode only)")
+	flag.BoolVar(&insecure, "insecure", false, "skip TLS certificate verification, e.g. for self-signed certs (client only)")
+	flag.StringVar(&ordersFile, "orders-file", defaultOrdersFile(), "file the 's' key appends saved orders to (client only)")
+	flag.IntVar(&feedSize, "feed-size", defaultFeedSize, "orders and activity lines kept in the feed for scrolling back (client only)")
+	flag.StringVar(&receiptFile, "receipt-file", defaultReceiptFile(), "file the 'e' key writes the session receipt to (client only)")
+	flag.DurationVar(&heartbeat, "heartbeat", 30*time.Second, "interval between server PINGs; clients that miss a PONG are dropped (0 disables, server mode only)")
+	flag.IntVar(&rateOrders, "rate-orders", 5, "maximum orders per connection within -rate-window (0 disables, server mode only)")
+	flag.DurationVar(&rateWindow, "rate-window", 10*time.Second, "window for -rate-orders (server mode only)")
+	flag.StringVar(&couponSrc, "coupons", "", `path to a JSON object of discount codes, e.g. {"SAVE10":{"percent":10},"TREAT":{"amount":2,"expires":"2026-12-31T23:59:59Z"}}; inline JSON is also accepted (server mode only)`)
+	flag.StringVar(&happySrc, "happy-hour", "", `path to a JSON array of happy hours taking a percentage off menu prices, e.g. [{"start":"15:00","end":"17:00","percent":20}], in server local time; inline JSON is also accepted (server mode only)`)
+	flag.Float64Var(&taxRate, "tax-rate", 0, "sales tax percentage added to order subtotals, e.g. 8.25 (server mode only)")
+	flag.StringVar(&logFile, "log-file", "", "write the server log to this file instead of stderr (server mode only)")
+	flag.Int64Var(&logMaxSize, "log-max-size", 10<<20, "rotate -log-file to <file>.1 once it exceeds this many bytes (0 disables, server mode only)")
+	flag.BoolVar(&quiet, "quiet", false, "log only errors, startup and shutdown instead of every join, leave, rename and order (server mode only)")
+	flag.StringVar(&dbPath, "db", "", "SQLite database file to record orders in (server mode only)")
+	flag.StringVar(&themeMode, "theme", "auto", "color theme: auto (follow the terminal background), dark or light (client only)")
+	flag.StringVar(&name, "name", "", "customer name that pre-fills new orders and is claimed as the chat username on connect (client only)")
+	flag.StringVar(&room, "room", defaultRoom, "chat room to join on connect; chat and orders are only seen within a room (client only)")
+	flag.StringVar(&bannerFile, "banner", "", "text file with ASCII art shown centered in place of the title when the terminal is big enough (client only)")
+	flag.StringVar(&configFile, "config", defaultConfigFile(), "JSON file with client settings: host, name, room, theme, keys, favorite (client only)")
+	flag.StringVar(&adminToken, "admin-token", "", "token that /admin must present to use STATUS and the menu commands (empty disables them, server mode only)")
+	flag.StringVar(&adminToken, "admin-secret", "", "same as -admin-token (server mode only)")
+	flag.IntVar(&maxConns, "max-conns", 0, "maximum concurrent client connections (0 means unlimited, server mode only)")
+	flag.DurationVar(&idle, "idle-timeout", 0, "disconnect clients that send nothing but PING/PONG heartbeats for this long (0 disables, server mode only)")
+	flag.IntVar(&maxQuantity, "max-quantity", 99, "maximum quantity of one item per order; the server rejects more and the client's form refuses it (0 disables)")
+	flag.DurationVar(&summaryIntv, "summary-interval", 0, "broadcast today's order count and revenue as [summary] this often, e.g. 15m (0 disables, server mode only)")
+	flag.IntVar(&bcastBuffer, "broadcast-buffer", 128, "capacity of the server's broadcast queue; when it is full, chat and /me lines are dropped (counted in STATS) instead of stalling the sender (server mode only)")
+	flag.IntVar(&maxChat, "max-chat", 500, "maximum characters in a chat, /me or /msg message; longer ones are rejected (0 disables, server mode only)")
+	flag.StringVar(&greeting, "greeting", "", "line sent to new connections after the welcome instead of the /name hint; {username} and {id} are replaced (server mode only)")
+	flag.StringVar(&wsAddr, "ws", "", "also serve the protocol over WebSocket on this host:port (server mode only)")
+	flag.StringVar(&wsPath, "ws-path", "/ws", "URL path of the WebSocket endpoint (server mode only)")
+	flag.StringVar(&wsOrigins, "ws-origins", "", "comma-separated extra browser origins allowed to use the WebSocket endpoint, e.g. example.com,*.example.org (server mode only)")
+	// Environment variables are applied as flag values first, so command-line
+	// flags still win.
+	if err := applyEnv(flag.CommandLine); err != nil {
+		log.Fatalf("Invalid environment: %v", err)
+	}
 	flag.Parse()
 
 	if serverOnly {
 		var menu []menuItem
-		if menuJSON != "" {
-			if err := json.Unmarshal([]byte(menuJSON), &menu); err != nil {
-				fmt.Printf("Invalid menu JSON: %v\n", err)
-				return
+		if menuSrc != "" {
+			m, err := loadMenu(menuSrc)
+			if err != nil {
+				log.Fatalf("Invalid menu: %v", err)
+			}
+			menu = m
+		}
+		if taxRate < 0 {
+			log.Fatalf("Invalid tax rate: %v", taxRate)
+		}
+		var coupons map[string]coupon
+		if couponSrc != "" {
+			c, err := loadCoupons(couponSrc)
+			if err != nil {
+				log.Fatalf("Invalid coupons: %v", err)
+			}
+			coupons = c
+		}
+		var happyHours []happyHour
+		if happySrc != "" {
+			hh, err := loadHappyHours(happySrc)
+			if err != nil {
+				log.Fatalf("Invalid happy hour: %v", err)
 			}
+			happyHours = hh
 		}
-		if err := startTCPServer(host, menu); err != nil {
+		cfg := serverConfig{
+			menu:            menu,
+			historySize:     history,
+			replaySize:      replaySize,
+			broadcastBuffer: bcastBuffer,
+			summaryInterval: summaryIntv,
+			heartbeat:       heartbeat,
+			orderLimit:      rateOrders,
+			orderWindow:     rateWindow,
+			taxRate:         taxRate,
+			coupons:         coupons,
+			happyHours:      happyHours,
+			logFile:         logFile,
+			logMaxSize:      logMaxSize,
+			quiet:           quiet,
+			dbPath:          dbPath,
+			adminToken:      adminToken,
+			maxConns:        maxConns,
+			idleTimeout:     idle,
+			maxChat:         maxChat,
+			maxQuantity:     maxQuantity,
+			greeting:        greeting,
+			wsAddr:          wsAddr,
+			wsPath:          wsPath,
+		}
+		if wsOrigins != "" {
+			cfg.wsOrigins = strings.Split(wsOrigins, ",")
+		}
+		if useTLS {
+			cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+			if err != nil {
+				log.Fatalf("Invalid TLS certificate: %v", err)
+			}
+			cfg.tls = &tls.Config{Certificates: []tls.Certificate{cert}}
+		}
+		if err := startTCPServer(host, cfg); err != nil {
 			fmt.Println("Server error:", err)
 		}
 		return
 	}
 
-	m := initialModel(host)
+	if !slices.Contains(themeModes, themeMode) {
+		log.Fatalf("Invalid theme: %q (want auto, dark or light)", themeMode)
+	}
+	if feedSize < 1 {
+		log.Fatalf("Invalid feed size: %d", feedSize)
+	}
+	fc, err := loadFileConfig(configFile)
+	if err != nil {
+		log.Fatalf("Invalid config: %v", err)
+	}
+	set := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	if !set["host"] && fc.Host != "" {
+		host = fc.Host
+	}
+	if !set["name"] {
+		name = fc.Name
+	}
+	if !set["room"] && fc.Room != "" {
+		room = fc.Room
+	}
+	if !set["connect-timeout"] && fc.ConnectTimeout != "" {
+		if connTimeout, err = time.ParseDuration(fc.ConnectTimeout); err != nil {
+			log.Fatalf("Invalid config: connectTimeout: %v", err)
+		}
+	}
+	if connTimeout <= 0 {
+		log.Fatalf("Invalid connect timeout: %v", connTimeout)
+	}
+	if sanitizeUsername(room) != room {
+		log.Fatalf("Invalid room: %q (allowed: letters, digits, _ . -)", room)
+	}
+	if bench {
+		if benchConns < 1 || !(benchRate > 0) || benchDur <= 0 {
+			log.Fatalf("Invalid bench: need -bench-clients >= 1, -bench-rate > 0 and -bench-duration > 0")
+		}
+		bcfg := benchConfig{
+			host:     host,
+			room:     room,
+			timeout:  connTimeout,
+			clients:  benchConns,
+			rate:     benchRate,
+			duration: benchDur,
+			itemID:   benchItem,
+		}
+		if useTLS {
+			bcfg.tls = &tls.Config{InsecureSkipVerify: insecure}
+		}
+		if err := runBench(os.Stdout, bcfg); err != nil {
+			log.Fatalf("Bench failed: %v", err)
+		}
+		return
+	}
+	var banner string
+	if bannerFile != "" {
+		b, err := os.ReadFile(bannerFile)
+		if err != nil {
+			log.Fatalf("Invalid banner: %v", err)
+		}
+		banner = strings.TrimRight(strings.ReplaceAll(string(b), "\r\n", "\n"), "\n")
+	}
+	ccfg := clientConfig{
+		host:          host,
+		maxReconnects: reconnects,
+		ordersFile:    ordersFile,
+		receiptFile:   receiptFile,
+		feedSize:      feedSize,
+		name:          name,
+		room:          room,
+		maxQuantity:   maxQuantity,
+		configFile:    configFile,
+		favorite:      fc.Favorite,
+		banner:        banner,
+		theme:         fc.Theme,
+		themeMode:     themeMode,
+		keys:          fc.Keys,
+	}
+	ccfg.connectTimeout = connTimeout
+	ccfg.readOnly = readOnly
+	if useTLS {
+		ccfg.tls = &tls.Config{InsecureSkipVerify: insecure}
+	}
+	m := initialModel(ccfg)
 	p := tea.NewProgram(m, tea.WithAltScreen())
 	if _, err := p.Run(); err != nil {
 		fmt.Println("error:", err)
@@ -0,0 +1,748 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/huh"
+	"github.com/charmbracelet/lipgloss"
+)
+
+// newTestModel is a client model as the flags set it up, with the dark theme
+// so no terminal query is made.
+func newTestModel() model {
+	return initialModel(clientConfig{host: "test", feedSize: defaultFeedSize, themeMode: "dark", connectTimeout: time.Second})
+}
+
+// pipeReader returns the client end of an in-memory connection and a func
+// that writes s to it from the server end.
+func pipeReader(t *testing.T) (net.Conn, *connReader, func(s string)) {
+	t.Helper()
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	write := func(s string) {
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, _ = io.WriteString(server, s)
+		}()
+		// net.Pipe writes wait for reads; let the read side take it.
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("write of %q not read", s)
+		}
+	}
+	return client, &connReader{Reader: bufio.NewReader(client)}, write
+}
+
+// poll runs one listenForBroadcastsCmd poll while s is written.
+func poll(t *testing.T, conn net.Conn, reader *connReader, write func(string), s string) broadcastMsg {
+	t.Helper()
+	msgs := make(chan tea.Msg, 1)
+	go func() { msgs <- listenForBroadcastsCmd(conn, reader)() }()
+	if s != "" {
+		write(s)
+	}
+	msg, ok := (<-msgs).(broadcastMsg)
+	if !ok {
+		t.Fatalf("poll returned %T", msg)
+	}
+	return msg
+}
+
+func TestListenKeepsLineCutOffByPollTimeout(t *testing.T) {
+	conn, reader, write := pipeReader(t)
+	if got := poll(t, conn, reader, write, "[chat]|2026-10-15T08:00:00Z|hel"); len(got) != 0 {
+		t.Fatalf("partial line delivered: %q", got)
+	}
+	if got := poll(t, conn, reader, write, ""); len(got) != 0 {
+		t.Fatalf("idle poll delivered: %q", got)
+	}
+	got := poll(t, conn, reader, write, "lo\n")
+	if want := "[chat]|2026-10-15T08:00:00Z|hello"; len(got) != 1 || got[0] != want {
+		t.Fatalf("got %q, want [%q]", got, want)
+	}
+}
+
+func TestListenDrainsBurstAndKeepsSplitLastLine(t *testing.T) {
+	conn, reader, write := pipeReader(t)
+	got := poll(t, conn, reader, write, "#1 [join]|2026-10-15T08:00:00Z|ann (a1)\n#2 [join]|2026-10-15T08:00:01Z|bob (b2)\n#3 [chat]|2026-10-15T08:00:02Z|sp")
+	want := []string{"#1 [join]|2026-10-15T08:00:00Z|ann (a1)", "#2 [join]|2026-10-15T08:00:01Z|bob (b2)"}
+	if len(got) != len(want) || got[0] != want[0] || got[1] != want[1] {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+	got = poll(t, conn, reader, write, "lit\n")
+	if want := "#3 [chat]|2026-10-15T08:00:02Z|split"; len(got) != 1 || got[0] != want {
+		t.Fatalf("got %q, want [%q]", got, want)
+	}
+}
+
+func TestParseItemQuantity(t *testing.T) {
+	for _, tc := range []struct {
+		in         string
+		fractional bool
+		want       float64
+		ok         bool
+	}{
+		{"2", false, 2, true},
+		{" 3 ", false, 3, true},
+		{"1.5", false, 0, false},
+		{"0", false, 0, false},
+		{"-1", false, 0, false},
+		{"0.75", true, 0.75, true},
+		{"2", true, 2, true},
+		{"0", true, 0, false},
+		{"-0.5", true, 0, false},
+		{"Inf", true, 0, false},
+		{"NaN", true, 0, false},
+	} {
+		got, err := parseItemQuantity(tc.in, tc.fractional)
+		if (err == nil) != tc.ok || got != tc.want {
+			t.Errorf("parseItemQuantity(%q, %v) = %v, %v", tc.in, tc.fractional, got, err)
+		}
+	}
+}
+
+func TestFractionalQuantityLabelsAndTotal(t *testing.T) {
+	m := newTestModel()
+	m.menu = testMenu()
+	if got := m.lineQuantity(orderLine{ItemID: "apples", Quantity: 0.75}); got != "0.75 kg" {
+		t.Errorf("apples quantity = %q", got)
+	}
+	if got := m.lineQuantity(orderLine{ItemID: "latte", Quantity: 2}); got != "2" {
+		t.Errorf("latte quantity = %q", got)
+	}
+
+	m.formFields.cart = []orderLine{{ItemID: "latte", Quantity: 1}}
+	m.formFields.itemID = "apples"
+	m.formFields.quantityStr = "0.75"
+	if got := m.previewTotal(); got != 6.9 {
+		t.Errorf("preview total = %v, want 6.9", got)
+	}
+	m.formFields.itemID = "latte"
+	m.formFields.quantityStr = "0.5"
+	if _, err := m.parseQuantity(m.formFields.quantityStr); err == nil {
+		t.Error("half a latte accepted")
+	}
+}
+
+func TestQuantityLimit(t *testing.T) {
+	m := newTestModel()
+	m.menu = testMenu()
+	m.maxQuantity = 5
+	m.formFields.itemID = "tea"
+	if limit, ok := m.quantityLimit(); !ok || limit != 2 {
+		t.Errorf("tea with an empty cart: %v, %v; want 2", limit, ok)
+	}
+	m.formFields.cart = []orderLine{{ItemID: "tea", Quantity: 2}}
+	if limit, ok := m.quantityLimit(); !ok || limit != 0 {
+		t.Errorf("tea with all of it in the cart: %v, %v; want 0", limit, ok)
+	}
+	m.formFields.itemID = "latte"
+	if limit, ok := m.quantityLimit(); !ok || limit != 5 {
+		t.Errorf("latte: %v, %v; want the cap of 5", limit, ok)
+	}
+	m.maxQuantity = 0
+	if _, ok := m.quantityLimit(); ok {
+		t.Error("latte without a cap is limited")
+	}
+}
+
+func TestQuantityStepper(t *testing.T) {
+	up, down := tea.KeyMsg{Type: tea.KeyUp}, tea.KeyMsg{Type: tea.KeyDown}
+	for _, tc := range []struct {
+		name    string
+		value   string
+		limit   float64
+		limited bool
+		key     tea.KeyMsg
+		want    string
+	}{
+		{"up", "1", 0, false, up, "2"},
+		{"up to the limit", "2", 2, true, up, "2"},
+		{"down stops at 1", "1", 0, false, down, "1"},
+		{"blank starts at 1", "", 3, true, up, "1"},
+		{"fractional stock left", "1", 0.5, true, up, "0.5"},
+		{"nothing left", "1", 0, true, up, "1"},
+		{"less than nothing left", "3", -1, true, down, "3"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			v := tc.value
+			q := &quantityStepper{
+				Input: huh.NewInput().Value(&v),
+				value: &v,
+				limit: func() (float64, bool) { return tc.limit, tc.limited },
+			}
+			q.Update(tc.key)
+			if v != tc.want {
+				t.Fatalf("got %q, want %q", v, tc.want)
+			}
+		})
+	}
+}
+
+// TestConcurrentMenuFetchAndListen fetches the menu from several goroutines
+// while broadcasts are being listened for on the same connection; run it
+// with -race. Every fetch must get the menu, and the listener must only get
+// broadcasts.
+func TestConcurrentMenuFetchAndListen(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	conn, reader, _, err := dialServer(addr, nil, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	chatter := dial(t, addr)
+
+	// The listener runs until the chat sent after all fetches arrives.
+	listened := make(chan []string)
+	go func() {
+		var got []string
+		for deadline := time.Now().Add(10 * time.Second); time.Now().Before(deadline); {
+			msg, ok := listenForBroadcastsCmd(conn, reader)().(broadcastMsg)
+			if !ok {
+				break
+			}
+			got = append(got, msg...)
+			if len(got) > 0 && strings.HasSuffix(got[len(got)-1], ": done") {
+				break
+			}
+		}
+		listened <- got
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := range 100 {
+			chatter.send("chat %d", i)
+		}
+	}()
+	errs := make(chan error, 100)
+	for range 4 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for range 10 {
+				msg := fetchMenu(conn, reader)
+				if msg.err == nil && len(msg.items) != len(testMenu()) {
+					msg.err = fmt.Errorf("got %d items", len(msg.items))
+				}
+				if msg.err != nil {
+					errs <- msg.err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	chatter.send("done")
+	got := <-listened
+	close(errs)
+	for err := range errs {
+		t.Errorf("fetch: %v", err)
+	}
+	if len(got) == 0 || !strings.HasSuffix(got[len(got)-1], ": done") {
+		t.Fatalf("listener missed the last chat; got %d lines", len(got))
+	}
+	for _, l := range got {
+		if _, rest := splitSeq(l); strings.HasPrefix(rest, "[error]") || json.Valid([]byte(rest)) {
+			t.Errorf("listener got %q", l)
+		}
+	}
+}
+
+// press sends the key s to m.
+func press(m model, s string) model {
+	updated, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune(s)})
+	return updated.(model)
+}
+
+func TestChatAndThemeKeys(t *testing.T) {
+	conn, _, _ := pipeReader(t)
+	m := newTestModel()
+	m.conn, m.loading = conn, false
+
+	m = press(m, "T")
+	if m.themeMode != "light" || m.chatInput != nil {
+		t.Fatalf("T: theme %q, chat open %v; want the light theme", m.themeMode, m.chatInput != nil)
+	}
+	m = press(m, "t")
+	if m.chatInput == nil || m.themeMode != "light" {
+		t.Fatalf("t: chat open %v, theme %q; want chat", m.chatInput != nil, m.themeMode)
+	}
+}
+
+func TestConnectedMsgDoesNotBlockUpdate(t *testing.T) {
+	// Nothing is ever written to conn, so a read in Update would hang.
+	conn, reader, _ := pipeReader(t)
+	m := newTestModel()
+	done := make(chan model)
+	go func() {
+		updated, _ := m.Update(connectedMsg{conn: conn, reader: reader, id: "abc123"})
+		done <- updated.(model)
+	}()
+	select {
+	case m = <-done:
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("Update blocked on connectedMsg")
+	}
+	if m.conn != conn || m.connID != "abc123" {
+		t.Fatalf("connection not taken: id %q", m.connID)
+	}
+}
+
+func TestConnectCmdConsumesGreeting(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	msg, ok := connectCmd(addr, nil, "", 0, time.Second)().(connectedMsg)
+	if !ok {
+		t.Fatalf("connect: %v", msg)
+	}
+	defer msg.conn.Close()
+	if msg.id == "" {
+		t.Error("connection id not read from the welcome line")
+	}
+	// The greeting is gone, so the first line read that is not a broadcast
+	// is the reply to the first request.
+	if _, err := fmt.Fprintln(msg.conn, "PING"); err != nil {
+		t.Fatal(err)
+	}
+	_ = msg.conn.SetReadDeadline(time.Now().Add(time.Second))
+	for {
+		l, err := msg.reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if seq, _ := splitSeq(l); seq > 0 {
+			continue
+		}
+		if l != "PONG\n" {
+			t.Fatalf("first reply after connect: %q, want PONG", l)
+		}
+		break
+	}
+}
+
+func TestSubmitOrderWaitsOnlyForTheAck(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	conn, reader, _, err := dialServer(addr, nil, "", time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	seen := map[string]bool{}
+	const n = 10
+	start := time.Now()
+	for i := range n {
+		msg := submitOrder(conn, order{Name: "ann", ItemID: "latte", Quantity: float64(i%3 + 1)}, reader)
+		if msg.err != nil || msg.ack != "OK" || seen[msg.orderID] {
+			t.Fatalf("order %d: %+v", i, msg)
+		}
+		// Each ack belongs to its own order, not an earlier one.
+		if want := 4.5 * float64(i%3+1); msg.total != want {
+			t.Fatalf("order %d: total %v, want %v", i, msg.total, want)
+		}
+		seen[msg.orderID] = true
+	}
+	// A loopback round trip takes well under a millisecond; a fixed delay
+	// per order would show.
+	if per := time.Since(start) / n; per > 50*time.Millisecond {
+		t.Fatalf("%v per order", per)
+	}
+}
+
+// orderPipe returns the client end of an in-memory connection, with the
+// order ack timeout cut to 100ms. Each order the server end reads is sent on
+// orders; ack queues an ok ack for nonce, written in the order queued.
+func orderPipe(t *testing.T) (net.Conn, *connReader, <-chan order, func(nonce, orderID string)) {
+	t.Helper()
+	timeout := orderAckTimeout
+	orderAckTimeout = 100 * time.Millisecond
+	t.Cleanup(func() { orderAckTimeout = timeout })
+
+	client, server := net.Pipe()
+	t.Cleanup(func() {
+		_ = client.Close()
+		_ = server.Close()
+	})
+	orders := make(chan order, 10)
+	go func() {
+		r := bufio.NewReader(server)
+		for {
+			l, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			var ord order
+			if raw, ok := strings.CutPrefix(l, "ORDERV2 "); ok && json.Unmarshal([]byte(raw), &ord) == nil {
+				orders <- ord
+			}
+		}
+	}()
+	acks := make(chan string, 10)
+	go func() {
+		for a := range acks {
+			if _, err := io.WriteString(server, a); err != nil {
+				return
+			}
+		}
+	}()
+	t.Cleanup(func() { close(acks) })
+	ack := func(nonce, orderID string) {
+		b, _ := json.Marshal(orderAck{Status: ackOK, Total: 3, OrderID: orderID, Nonce: nonce})
+		acks <- string(b) + "\n"
+	}
+	return client, &connReader{Reader: bufio.NewReader(client)}, orders, ack
+}
+
+// received returns the next order the server end of orderPipe read.
+func received(t *testing.T, orders <-chan order) order {
+	t.Helper()
+	select {
+	case ord := <-orders:
+		return ord
+	case <-time.After(time.Second):
+		t.Fatal("no order sent")
+		return order{}
+	}
+}
+
+func TestLateAckIsNotTakenForTheNextOrder(t *testing.T) {
+	conn, reader, orders, ack := orderPipe(t)
+
+	first := submitOrderV2Cmd(conn, order{Name: "ann", ItemID: "tea", Quantity: 1}, reader)()
+	if msg := first.(orderSubmittedMsg); msg.err == nil || !strings.Contains(msg.err.Error(), "timeout") {
+		t.Fatalf("first order: %+v", msg)
+	}
+	late := received(t, orders)
+	select {
+	case ord := <-orders:
+		t.Fatalf("order sent again: %+v", ord)
+	default:
+	}
+	// The first order's ack arrives after it timed out.
+	ack(late.Nonce, "late1")
+
+	result := make(chan tea.Msg, 1)
+	go func() { result <- submitOrderV2Cmd(conn, order{Name: "ann", ItemID: "latte", Quantity: 1}, reader)() }()
+	next := received(t, orders)
+	ack(next.Nonce, "next2")
+	if msg := (<-result).(orderSubmittedMsg); msg.err != nil || msg.orderID != "next2" {
+		t.Fatalf("next order got %+v", msg)
+	}
+}
+
+func TestListenSkipsLateOrderAck(t *testing.T) {
+	conn, reader, write := pipeReader(t)
+	got := poll(t, conn, reader, write, `{"status":"ok","total":3,"orderId":"late1","nonce":"n1"}`+"\n[chat]|2026-10-15T08:00:00Z|hi\n")
+	if want := "[chat]|2026-10-15T08:00:00Z|hi"; len(got) != 1 || got[0] != want {
+		t.Fatalf("got %q, want [%q]", got, want)
+	}
+}
+
+// resize sends m a window size.
+func resize(m model, w, h int) model {
+	updated, _ := m.Update(tea.WindowSizeMsg{Width: w, Height: h})
+	return updated.(model)
+}
+
+func TestViewFitsSmallTerminals(t *testing.T) {
+	for _, size := range [][2]int{{120, 40}, {narrowWidth, 20}, {narrowWidth - 1, 20}, {40, 30}, {40, 12}, {30, 5}, {10, 3}, {1, 1}} {
+		w, h := size[0], size[1]
+		m := resize(newTestModel(), w, h)
+		m.applyBroadcasts([]string{"#1 [order]|2026-10-15T08:00:00Z|ann ordered 2 × Latte ($9.00)"})
+		m.refreshFeed()
+		view := m.View()
+		for _, l := range strings.Split(view, "\n") {
+			if lw := lipgloss.Width(l); lw > w && w >= 30 {
+				t.Errorf("%dx%d: line %d wide: %q", w, h, lw, l)
+			}
+		}
+		if w < narrowWidth && h >= 20 {
+			// Stacked: the feed comes below the status column, not beside it.
+			lines := strings.Split(view, "\n")
+			status, feed := -1, -1
+			for i, l := range lines {
+				if status < 0 && strings.Contains(l, "Status") {
+					status = i
+				}
+				if feed < 0 && strings.Contains(l, "Latte") {
+					feed = i
+				}
+			}
+			if status < 0 || feed <= status {
+				t.Errorf("%dx%d: status at line %d, feed at line %d; want the feed below", w, h, status, feed)
+			}
+		}
+	}
+}
+
+func TestEmptyMenuOpensNoForm(t *testing.T) {
+	cfg := testServerConfig()
+	cfg.menu = nil
+	tc := dialHub(t, cfg)
+	msg := fetchMenu(tc.c, &connReader{Reader: tc.r})
+	if msg.err != nil || len(msg.items) != 0 {
+		t.Fatalf("fetch of an empty menu: %+v", msg)
+	}
+
+	m := newTestModel()
+	m.loading = true
+	updated, _ := m.Update(msg)
+	m = updated.(model)
+	if m.form != nil || m.loading || m.status != "Menu is empty, nothing to order." {
+		t.Fatalf("form open %v, loading %v, status %q", m.form != nil, m.loading, m.status)
+	}
+}
+
+func TestConnectTimeout(t *testing.T) {
+	// The listener accepts but never answers the TLS handshake, which the
+	// dial timeout covers.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	m := newTestModel()
+	if want := "Connecting to test..."; m.status != want {
+		t.Errorf("initial status %q, want %q", m.status, want)
+	}
+	addr := ln.Addr().String()
+	start := time.Now()
+	msg := connectCmd(addr, &tls.Config{InsecureSkipVerify: true}, "", 0, 200*time.Millisecond)()
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("gave up after %v, want about 200ms", waited)
+	}
+	status, ok := msg.(statusMsg)
+	if want := fmt.Sprintf("Connect failed: no answer from %s after ", addr); !ok || !strings.HasPrefix(string(status), want) || !strings.HasSuffix(string(status), "ms.") {
+		t.Fatalf("got %v, want %q and the time waited", msg, want)
+	}
+	updated, _ := m.Update(status)
+	if got := updated.(model).status; !strings.HasSuffix(got, " Press 'r' to retry.") {
+		t.Fatalf("status %q offers no retry", got)
+	}
+}
+
+func TestFetchMenuSkipsInterleavedLines(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go func() {
+		r := bufio.NewReader(server)
+		if l, _ := r.ReadString('\n'); l != "MENU\n" {
+			return
+		}
+		io.WriteString(server, "#7 [join]|2026-10-15T08:00:00Z|bob (b2)\n"+
+			"[order]|2026-10-15T08:00:01Z|bob ordered 1 × Tea ($3.00)\n"+
+			"bob (b2): anyone here?\n"+
+			"PING\n")
+		// The client answers the heartbeat before it reads on.
+		if l, _ := r.ReadString('\n'); l != "PONG\n" {
+			return
+		}
+		io.WriteString(server, `[{"id":"latte","name":"Latte","price":4.5}]`+"\n")
+	}()
+	msg := fetchMenu(client, &connReader{Reader: bufio.NewReader(client)})
+	if msg.err != nil || len(msg.items) != 1 || msg.items[0].ID != "latte" {
+		t.Fatalf("got %+v", msg)
+	}
+}
+
+// orderResult runs cmd, a batch that submits an order, and returns the
+// submission's result.
+func orderResult(t *testing.T, cmd tea.Cmd) orderSubmittedMsg {
+	t.Helper()
+	batch, ok := cmd().(tea.BatchMsg)
+	if !ok {
+		t.Fatal("not a batch")
+	}
+	for _, c := range batch {
+		if c == nil {
+			continue
+		}
+		if msg, ok := c().(orderSubmittedMsg); ok {
+			return msg
+		}
+	}
+	t.Fatal("no order submitted")
+	return orderSubmittedMsg{}
+}
+
+func TestRetryOrder(t *testing.T) {
+	conn, reader, orders, ack := orderPipe(t)
+	m := newTestModel()
+	m.conn, m.reader, m.loading = conn, reader, false
+
+	// The first attempt reaches the server, but its ack comes too late.
+	sent := orderResult(t, m.sendOrder(order{Name: "ann", ItemID: "tea", Quantity: 1}, "Submitting order..."))
+	if sent.err == nil {
+		t.Fatalf("first attempt: %+v", sent)
+	}
+	first := received(t, orders)
+	updated, _ := m.Update(sent)
+	m = updated.(model)
+	if !m.retryable || m.status != "Order submission failed. Press 'R' to retry it." {
+		t.Fatalf("after a lost ack: retryable %v, status %q", m.retryable, m.status)
+	}
+	ack(first.Nonce, "a1")
+
+	updated, cmd := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune("R")})
+	m = updated.(model)
+	if m.orderRetries != 1 || m.status != "Retrying order (retry 1)..." {
+		t.Fatalf("retry: %d retries, status %q", m.orderRetries, m.status)
+	}
+	retried := orderResult(t, cmd)
+	if resent := received(t, orders); resent.Nonce != first.Nonce {
+		t.Fatalf("retry sent nonce %q, first attempt %q", resent.Nonce, first.Nonce)
+	}
+	// The server answers the resent nonce with the same order again.
+	ack(first.Nonce, "a1")
+	if retried.err != nil || retried.orderID != "a1" {
+		t.Fatalf("retry got %+v", retried)
+	}
+	updated, _ = m.Update(retried)
+	m = updated.(model)
+	if m.retryable || m.status != "Order submitted on retry 1. Total: $3.00" {
+		t.Fatalf("after the retry: retryable %v, status %q", m.retryable, m.status)
+	}
+
+	// The retry's own ack is still on the way; the next order skips it.
+	cmd = m.sendOrder(order{Name: "ann", ItemID: "latte", Quantity: 1}, "Submitting order...")
+	ack(m.lastOrder.Nonce, "b2")
+	if next := orderResult(t, cmd); next.err != nil || next.orderID != "b2" {
+		t.Fatalf("next order got %+v", next)
+	}
+
+	// A rejected order is not offered for retry.
+	m.sendOrder(order{Name: "ann", ItemID: "mocha", Quantity: 1}, "Submitting order...")
+	updated, _ = m.Update(orderSubmittedMsg{err: rejection("unknown item")})
+	if m = updated.(model); m.retryable {
+		t.Fatal("rejected order offered for retry")
+	}
+	m = press(m, "R")
+	if m.status != "No failed order to retry." {
+		t.Fatalf("R after a rejection: %q", m.status)
+	}
+}
+
+func TestSoldOutOptionLabel(t *testing.T) {
+	m := newTestModel()
+	none := 0.0
+	m.menu = append(testMenu(), menuItem{ID: "scone", Name: "Scone", Price: 2.5, Stock: &none})
+	opts := m.menuOptions(m.menu)
+	for i, o := range opts {
+		if sold := strings.HasSuffix(o.Key, " (sold out)"); sold != (o.Value == "scone") {
+			t.Errorf("option %d (%s): %q", i, o.Value, o.Key)
+		}
+	}
+}
+
+func TestSoldOutRejectionRefetchesStock(t *testing.T) {
+	conn, _, _ := pipeReader(t)
+	// stock returns a copy of the test menu with tea's stock set to q.
+	stock := func(q float64) []menuItem {
+		menu := testMenu()
+		menu[1].Stock = &q
+		return menu
+	}
+	for _, tc := range []struct {
+		menu []menuItem
+		want string
+	}{
+		{stock(1), "Server rejected order, stock changed: Tea has only 1 left"},
+		{stock(0), "Server rejected order, stock changed: Tea sold out"},
+		// Back in stock by the time it is fetched again.
+		{stock(5), "Server rejected order: sold out"},
+	} {
+		m := newTestModel()
+		m.conn, m.menu = conn, testMenu()
+		m.lastOrder = &order{Name: "ann", Items: []orderLine{{ItemID: "latte", Quantity: 1}, {ItemID: "tea", Quantity: 2}}}
+		updated, cmd := m.Update(orderSubmittedMsg{err: rejection("sold out")})
+		m = updated.(model)
+		if !m.checkingStock || cmd == nil {
+			t.Fatal("sold-out rejection did not re-fetch the menu")
+		}
+		updated, _ = m.Update(menuLoadedMsg{items: tc.menu})
+		m = updated.(model)
+		if m.serverError != tc.want || m.checkingStock {
+			t.Errorf("got %q, want %q", m.serverError, tc.want)
+		}
+	}
+}
+
+// settle feeds form the messages its commands send, as the program would,
+// for a few rounds. Commands that wait, like cursor blinks, are dropped.
+func settle(form *huh.Form, cmd tea.Cmd) {
+	cmds := []tea.Cmd{cmd}
+	for range 5 {
+		var next []tea.Cmd
+		for _, c := range cmds {
+			if c == nil {
+				continue
+			}
+			msgs := make(chan tea.Msg, 1)
+			go func() { msgs <- c() }()
+			var msg tea.Msg
+			select {
+			case msg = <-msgs:
+			case <-time.After(50 * time.Millisecond):
+				continue
+			}
+			if batch, ok := msg.(tea.BatchMsg); ok {
+				next = append(next, batch...)
+				continue
+			}
+			_, c := form.Update(msg)
+			next = append(next, c)
+		}
+		cmds = next
+	}
+}
+
+func TestMenuItemDescriptionKeepsFilterHint(t *testing.T) {
+	m := newTestModel()
+	m.menu = testMenu()
+	m.menu[0].Description = "Espresso with steamed milk"
+	m = resize(m, 100, 40)
+	for _, tc := range []struct {
+		itemID string
+		want   []string
+	}{
+		{"latte", []string{"Espresso with steamed milk", "Press / to filter by name"}},
+		{"tea", []string{"Press / to filter by name"}},
+	} {
+		m.formFields.prefill = &favorite{Name: "ann", ItemID: tc.itemID, Quantity: 1}
+		form := m.buildForm()
+		settle(form, form.Init())
+		view := form.View()
+		for _, want := range tc.want {
+			if !strings.Contains(view, want) {
+				t.Errorf("%s: %q not shown:\n%s", tc.itemID, want, view)
+			}
+		}
+	}
+}
@@ -2,15 +2,34 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"database/sql"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"math"
 	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/coder/websocket"
 	gonanoid "github.com/matoous/go-nanoid/v2"
+	_ "modernc.org/sqlite"
 )
 
 var defaultMenu = []menuItem{
@@ -19,13 +38,730 @@ var defaultMenu = []menuItem{
 	{ID: "esp", Name: "Espresso", Price: 3.00},
 }
 
-var serverMenu []menuItem
+// idAlphabet is used for both connection and order IDs.
+const idAlphabet = "abcdef0123456789"
 
-// order is the structure the server expects for ORDER.
+// loadMenu reads a menu either from a JSON file path or, for backward
+// compatibility, from an inline JSON array, and validates it.
+func loadMenu(src string) ([]menuItem, error) {
+	var data []byte
+	if strings.HasPrefix(strings.TrimSpace(src), "[") {
+		data = []byte(src)
+	} else {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("read menu file: %w", err)
+		}
+		data = b
+	}
+
+	if err := checkMenuFields(data); err != nil {
+		return nil, err
+	}
+	var menu []menuItem
+	if err := json.Unmarshal(data, &menu); err != nil {
+		return nil, fmt.Errorf("parse menu JSON: %w", err)
+	}
+	if err := validateMenu(menu); err != nil {
+		return nil, err
+	}
+	return menu, nil
+}
+
+// coupon is a discount code worth Percent of the subtotal or a flat Amount.
+// A zero Expires means it never expires.
+type coupon struct {
+	Percent float64   `json:"percent,omitempty"`
+	Amount  float64   `json:"amount,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+func (c coupon) expired(now time.Time) bool {
+	return !c.Expires.IsZero() && now.After(c.Expires)
+}
+
+// discount is the amount taken off subtotal, never more than the subtotal.
+func (c coupon) discount(subtotal float64) float64 {
+	if c.Percent > 0 {
+		return roundCents(subtotal * c.Percent / 100)
+	}
+	return min(roundCents(c.Amount), subtotal)
+}
+
+// loadCoupons reads coupons from a JSON file, or an inline JSON object,
+// mapping codes to coupons. Codes are case-insensitive.
+func loadCoupons(src string) (map[string]coupon, error) {
+	var data []byte
+	if strings.HasPrefix(strings.TrimSpace(src), "{") {
+		data = []byte(src)
+	} else {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("read coupons file: %w", err)
+		}
+		data = b
+	}
+
+	var raw map[string]coupon
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("parse coupons JSON: %w", err)
+	}
+	coupons := make(map[string]coupon, len(raw))
+	for code, c := range raw {
+		key := strings.ToUpper(strings.TrimSpace(code))
+		switch {
+		case key == "":
+			return nil, fmt.Errorf("coupon with empty code")
+		case (c.Percent > 0) == (c.Amount > 0), c.Percent < 0, c.Amount < 0, c.Percent > 100:
+			return nil, fmt.Errorf("coupon %s: set either percent (up to 100) or amount", code)
+		}
+		coupons[key] = c
+	}
+	return coupons, nil
+}
+
+// happyHour takes Percent off menu prices from Start until End ("15:04",
+// server local time). A window that ends before it starts runs past midnight.
+type happyHour struct {
+	Start   string  `json:"start"`
+	End     string  `json:"end"`
+	Percent float64 `json:"percent"`
+	// start and end are minutes after midnight.
+	start, end int
+}
+
+func (hh happyHour) active(now time.Time) bool {
+	m := now.Hour()*60 + now.Minute()
+	if hh.start < hh.end {
+		return m >= hh.start && m < hh.end
+	}
+	return m >= hh.start || m < hh.end
+}
+
+// loadHappyHours reads happy-hour windows from a JSON file, or an inline
+// JSON array.
+func loadHappyHours(src string) ([]happyHour, error) {
+	var data []byte
+	if strings.HasPrefix(strings.TrimSpace(src), "[") {
+		data = []byte(src)
+	} else {
+		b, err := os.ReadFile(src)
+		if err != nil {
+			return nil, fmt.Errorf("read happy hour file: %w", err)
+		}
+		data = b
+	}
+
+	var hours []happyHour
+	if err := json.Unmarshal(data, &hours); err != nil {
+		return nil, fmt.Errorf("parse happy hour JSON: %w", err)
+	}
+	for i := range hours {
+		hh := &hours[i]
+		start, err := time.Parse("15:04", hh.Start)
+		if err != nil {
+			return nil, fmt.Errorf("happy hour %d: invalid start %q", i, hh.Start)
+		}
+		end, err := time.Parse("15:04", hh.End)
+		if err != nil {
+			return nil, fmt.Errorf("happy hour %d: invalid end %q", i, hh.End)
+		}
+		hh.start = start.Hour()*60 + start.Minute()
+		hh.end = end.Hour()*60 + end.Minute()
+		if hh.start == hh.end {
+			return nil, fmt.Errorf("happy hour %d: start and end are the same", i)
+		}
+		if hh.Percent <= 0 || hh.Percent > 100 {
+			return nil, fmt.Errorf("happy hour %d: percent must be above 0 and up to 100", i)
+		}
+	}
+	return hours, nil
+}
+
+// happyHourPercent is the discount of the first happy hour active at now, or 0.
+func (h *Hub) happyHourPercent(now time.Time) float64 {
+	for _, hh := range h.cfg.happyHours {
+		if hh.active(now) {
+			return hh.Percent
+		}
+	}
+	return 0
+}
+
+// discounted returns the item with percent taken off its price and its
+// modifier prices.
+func (it menuItem) discounted(percent float64) menuItem {
+	if percent <= 0 {
+		return it
+	}
+	off := func(p float64) float64 { return roundCents(p * (100 - percent) / 100) }
+	it.Price = off(it.Price)
+	groups := make([]modifierGroup, len(it.Modifiers))
+	for i, g := range it.Modifiers {
+		g.Choices = slices.Clone(g.Choices)
+		for j := range g.Choices {
+			g.Choices[j].Price = off(g.Choices[j].Price)
+		}
+		groups[i] = g
+	}
+	it.Modifiers = groups
+	return it
+}
+
+// menuStore guards the served menu, whose stock is updated concurrently by
+// connection goroutines.
+type menuStore struct {
+	mu    sync.Mutex
+	items []menuItem
+}
+
+func newMenuStore(items []menuItem) *menuStore {
+	s := &menuStore{items: make([]menuItem, 0, len(items))}
+	for _, it := range items {
+		s.items = append(s.items, it.clone())
+	}
+	return s
+}
+
+// clone copies an item so its stock is not shared with the original.
+func (it menuItem) clone() menuItem {
+	if it.Stock != nil {
+		n := *it.Stock
+		it.Stock = &n
+	}
+	return it
+}
+
+// snapshot returns a copy of the current menu, including remaining stock,
+// with percent taken off the prices.
+func (s *menuStore) snapshot(percent float64) []menuItem {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]menuItem, 0, len(s.items))
+	for _, it := range s.items {
+		out = append(out, it.clone().discounted(percent))
+	}
+	return out
+}
+
+// item returns a copy of the item with the given ID, ignoring case, with
+// percent taken off its prices.
+func (s *menuStore) item(id string, percent float64) (menuItem, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexLocked(id)
+	if i < 0 {
+		return menuItem{}, false
+	}
+	return s.items[i].clone().discounted(percent), true
+}
+
+// indexLocked finds an item by ID, ignoring case.
+func (s *menuStore) indexLocked(id string) int {
+	for i := range s.items {
+		if strings.EqualFold(s.items[i].ID, id) {
+			return i
+		}
+	}
+	return -1
+}
+
+// reserve validates the order lines and atomically takes their quantities
+// out of stock. It returns the chosen item for each line, priced (less
+// percent) and named with its modifiers, or a rejection reason.
+func (s *menuStore) reserve(lines []orderLine, percent float64) ([]menuItem, string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	chosen := make([]menuItem, 0, len(lines))
+	wanted := make(map[int]float64)
+	for _, ol := range lines {
+		if ol.Quantity <= 0 {
+			return nil, "invalid quantity"
+		}
+		i := s.indexLocked(ol.ItemID)
+		if i < 0 {
+			return nil, "unknown item"
+		}
+		if !s.items[i].fractional() && ol.Quantity != math.Trunc(ol.Quantity) {
+			return nil, "invalid quantity"
+		}
+		it, reject := s.items[i].clone().discounted(percent).withModifiers(ol.Modifiers)
+		if reject != "" {
+			return nil, reject
+		}
+		// validateMenu should rule this out. With every line non-negative,
+		// so is the total, as discounts never exceed the subtotal.
+		if it.Price < 0 {
+			return nil, "invalid price"
+		}
+		wanted[i] += ol.Quantity
+		chosen = append(chosen, it)
+	}
+	for i, qty := range wanted {
+		if st := s.items[i].Stock; st != nil && *st < qty {
+			return nil, "sold out"
+		}
+	}
+	for i, qty := range wanted {
+		if st := s.items[i].Stock; st != nil {
+			// Keep fractional stock free of float noise, to a thousandth.
+			*st = math.Round((*st-qty)*1000) / 1000
+		}
+	}
+	return chosen, ""
+}
+
+// add appends a copy of it to the menu, unless its ID is taken, and returns
+// a rejection reason otherwise.
+func (s *menuStore) add(it menuItem) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.indexLocked(it.ID) >= 0 {
+		return "duplicate id"
+	}
+	s.items = append(s.items, it.clone())
+	return ""
+}
+
+// remove deletes the item with the given ID, ignoring case. The last item
+// stays, as an empty menu cannot be ordered from.
+func (s *menuStore) remove(id string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexLocked(id)
+	if i < 0 {
+		return "unknown item"
+	}
+	if len(s.items) == 1 {
+		return "cannot remove the last item"
+	}
+	s.items = slices.Delete(s.items, i, i+1)
+	return ""
+}
+
+// setPrice changes the base price of the item with the given ID, ignoring
+// case, as long as its modifiers keep it from going below zero.
+func (s *menuStore) setPrice(id string, price float64) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := s.indexLocked(id)
+	if i < 0 {
+		return "unknown item"
+	}
+	it := s.items[i]
+	it.Price = price
+	if err := validateItem(it); err != nil {
+		return err.Error()
+	}
+	s.items[i] = it
+	return ""
+}
+
+// validateMenu rejects empty menus, entries with missing fields and duplicate
+// IDs. IDs are matched case-insensitively, so "latte" and "LATTE" collide.
+func validateMenu(menu []menuItem) error {
+	if len(menu) == 0 {
+		return fmt.Errorf("menu has no items")
+	}
+	seen := make(map[string]int, len(menu))
+	for i, it := range menu {
+		if err := validateItem(it); err != nil {
+			if strings.TrimSpace(it.ID) == "" {
+				return fmt.Errorf("menu item %d: %w", i, err)
+			}
+			return fmt.Errorf("menu item %d (%s): %w", i, it.ID, err)
+		}
+		key := strings.ToLower(it.ID)
+		if j, dup := seen[key]; dup {
+			return fmt.Errorf("menu item %d: duplicate id %q (also item %d)", i, it.ID, j)
+		}
+		seen[key] = i
+	}
+	return nil
+}
+
+// validateItem rejects a menu item with a missing id or name, or a price
+// that can drop below zero. Free items are allowed; a missing price is
+// caught by checkItemFields before decoding turns it into zero.
+func validateItem(it menuItem) error {
+	switch {
+	case strings.TrimSpace(it.ID) == "":
+		return errors.New("missing id")
+	case strings.TrimSpace(it.Name) == "":
+		return errors.New("missing name")
+	case it.Price < 0:
+		return errors.New("negative price")
+	case it.Stock != nil && *it.Stock < 0:
+		return errors.New("negative stock")
+	}
+	for k, g := range it.Modifiers {
+		if strings.TrimSpace(g.Name) == "" || len(g.Choices) == 0 {
+			return fmt.Errorf("modifier %d needs a name and choices", k)
+		}
+	}
+	if it.lowestPrice() < 0 {
+		return errors.New("modifiers can take the price below zero")
+	}
+	return nil
+}
+
+// itemFields, modifierFields and choiceFields give the JSON kind of each
+// field of a menu item, modifier group and choice; "!" marks required ones.
+var (
+	itemFields = map[string]string{
+		"id": "string!", "name": "string!", "price": "number!", "stock": "number",
+		"unit": "string", "category": "string", "description": "string", "modifiers": "array",
+	}
+	modifierFields = map[string]string{"name": "string!", "multi": "bool", "choices": "array!"}
+	choiceFields   = map[string]string{"name": "string!", "price": "number"}
+)
+
+// checkMenuFields checks the raw menu JSON before it is decoded, since
+// decoding quietly zeroes missing fields and reports mistyped ones without
+// saying which item they are in. Errors name the item by index, e.g.
+// `menu item 2 (latte): modifier 0: choice 1: "price" must be a number, got string`.
+func checkMenuFields(data []byte) error {
+	var items []json.RawMessage
+	if err := json.Unmarshal(data, &items); err != nil {
+		if k := jsonKind(data); k != "array" {
+			return fmt.Errorf("parse menu JSON: want an array of items, got %s", k)
+		}
+		return fmt.Errorf("parse menu JSON: %w", err)
+	}
+	for i, raw := range items {
+		label := fmt.Sprintf("menu item %d", i)
+		var probe struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(raw, &probe) == nil && probe.ID != "" {
+			label += " (" + probe.ID + ")"
+		}
+		if err := checkItemFields(raw); err != nil {
+			return fmt.Errorf("%s: %w", label, err)
+		}
+	}
+	return nil
+}
+
+// checkItemFields checks the fields of one menu item and its modifiers.
+func checkItemFields(raw json.RawMessage) error {
+	item, err := checkFields(raw, itemFields)
+	if err != nil {
+		return err
+	}
+	var groups []json.RawMessage
+	_ = json.Unmarshal(item["modifiers"], &groups)
+	for k, g := range groups {
+		group, err := checkFields(g, modifierFields)
+		if err != nil {
+			return fmt.Errorf("modifier %d: %w", k, err)
+		}
+		var choices []json.RawMessage
+		_ = json.Unmarshal(group["choices"], &choices)
+		for c, choice := range choices {
+			if _, err := checkFields(choice, choiceFields); err != nil {
+				return fmt.Errorf("modifier %d: choice %d: %w", k, c, err)
+			}
+		}
+	}
+	return nil
+}
+
+// checkFields checks that raw is an object whose fields have the kinds in
+// want, and returns it keyed by the names in want. Like decoding, it matches
+// names ignoring case and leaves other fields alone.
+func checkFields(raw json.RawMessage, want map[string]string) (map[string]json.RawMessage, error) {
+	var obj map[string]json.RawMessage
+	if k := jsonKind(raw); k != "object" {
+		return nil, fmt.Errorf("want an object, got %s", k)
+	}
+	if err := json.Unmarshal(raw, &obj); err != nil {
+		return nil, err
+	}
+	fields := make(map[string]json.RawMessage, len(want))
+	for key, v := range obj {
+		for name := range want {
+			if strings.EqualFold(key, name) {
+				fields[name] = v
+			}
+		}
+	}
+	names := make([]string, 0, len(want))
+	for name := range want {
+		names = append(names, name)
+	}
+	// Check in a fixed order so the same menu always gets the same error.
+	sort.Strings(names)
+	for _, name := range names {
+		kind, required := strings.CutSuffix(want[name], "!")
+		v, ok := fields[name]
+		switch got := jsonKind(v); {
+		case !ok && required:
+			return nil, fmt.Errorf("missing %q", name)
+		case !ok || (got == "null" && !required):
+		case got != kind:
+			article := "a"
+			if kind == "array" {
+				article = "an"
+			}
+			return nil, fmt.Errorf("%q must be %s %s, got %s", name, article, kind, got)
+		}
+	}
+	return fields, nil
+}
+
+// jsonKind names the kind of JSON value raw holds from its first byte.
+func jsonKind(raw []byte) string {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 {
+		return "nothing"
+	}
+	switch raw[0] {
+	case '{':
+		return "object"
+	case '[':
+		return "array"
+	case '"':
+		return "string"
+	case 't', 'f':
+		return "bool"
+	case 'n':
+		return "null"
+	}
+	return "number"
+}
+
+// lowestPrice is the item's price with the cheapest modifier choices: the
+// cheapest choice of each single-choice group and every discount of each
+// multi-choice group.
+func (it menuItem) lowestPrice() float64 {
+	p := it.Price
+	for _, g := range it.Modifiers {
+		if g.Multi {
+			for _, c := range g.Choices {
+				p += min(c.Price, 0)
+			}
+			continue
+		}
+		cheapest := g.Choices[0].Price
+		for _, c := range g.Choices[1:] {
+			cheapest = min(cheapest, c.Price)
+		}
+		p += cheapest
+	}
+	return p
+}
+
+// order is the structure the server expects for ORDER. It either carries
+// a single item (legacy ItemID/Quantity) or a cart of Items.
 type order struct {
-	Name     string `json:"name"`
-	ItemID   string `json:"itemId"`
-	Quantity int    `json:"quantity"`
+	Name     string      `json:"name"`
+	ItemID   string      `json:"itemId,omitempty"`
+	Quantity float64     `json:"quantity,omitempty"`
+	Items    []orderLine `json:"items,omitempty"`
+	// At most one of TipPercent (of the subtotal) or TipAmount (flat) is set.
+	TipPercent float64 `json:"tipPercent,omitempty"`
+	TipAmount  float64 `json:"tipAmount,omitempty"`
+	// Coupon is an optional discount code.
+	Coupon string `json:"coupon,omitempty"`
+	// Nonce identifies one order across resubmissions of it, so the server
+	// places it only once.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+// orderLine is a single cart entry of an order.
+type orderLine struct {
+	ItemID   string  `json:"itemId"`
+	Quantity float64 `json:"quantity"`
+	// Modifiers maps a modifier group name to the chosen choice names.
+	Modifiers map[string][]string `json:"modifiers,omitempty"`
+}
+
+// newOrder builds an order, using the legacy single-item shape when the
+// cart holds one line without modifiers so older servers still accept it.
+func newOrder(name string, lines []orderLine) order {
+	if len(lines) == 1 && len(lines[0].Modifiers) == 0 {
+		return order{Name: name, ItemID: lines[0].ItemID, Quantity: lines[0].Quantity}
+	}
+	return order{Name: name, Items: lines}
+}
+
+// lines returns the order's cart, normalizing the legacy single-item shape.
+func (o order) lines() []orderLine {
+	if len(o.Items) > 0 {
+		return o.Items
+	}
+	return []orderLine{{ItemID: o.ItemID, Quantity: o.Quantity}}
+}
+
+// serverConfig holds the options the server is started with.
+type serverConfig struct {
+	menu        []menuItem
+	historySize int
+	// replaySize is how many recent broadcasts REPLAY can resend.
+	replaySize int
+	// broadcastBuffer is the capacity of the hub's broadcast queue.
+	broadcastBuffer int
+	// summaryInterval is how often today's totals are broadcast as
+	// [summary]; zero disables it.
+	summaryInterval time.Duration
+	// heartbeat is the PING interval; zero disables heartbeats.
+	heartbeat time.Duration
+	// orderLimit orders are allowed per connection within orderWindow; zero disables the limit.
+	orderLimit  int
+	orderWindow time.Duration
+	// taxRate is the sales tax percentage applied to order subtotals.
+	taxRate float64
+	// coupons maps upper-cased discount codes to their coupons.
+	coupons map[string]coupon
+	// happyHours are scheduled discounts on menu prices.
+	happyHours []happyHour
+	// maxQuantity caps the quantity of each order line; zero means no limit.
+	maxQuantity int
+	// logFile, when set, receives the server log instead of stderr. It is
+	// rotated to logFile+".1" once it would exceed logMaxSize bytes (zero
+	// disables rotation).
+	logFile    string
+	logMaxSize int64
+	// quiet logs only errors besides startup and shutdown.
+	quiet bool
+	// wsAddr, when set, also serves the protocol over WebSocket at wsPath.
+	// wsOrigins lists extra allowed browser origins (host patterns); the
+	// request's own host is always allowed.
+	wsAddr    string
+	wsPath    string
+	wsOrigins []string
+	// greeting replaces the line sent after the welcome; {username} and {id}
+	// are substituted. Empty means defaultGreeting.
+	greeting string
+	// idleTimeout disconnects clients that send nothing but heartbeats for that
+	// long; zero disables it.
+	idleTimeout time.Duration
+	// maxChat caps chat, /me and /msg text in characters; longer lines are
+	// rejected. Zero means no limit.
+	maxChat int
+	// maxConns caps concurrent connections; extra ones are told the server is
+	// full and closed. Zero means no limit.
+	maxConns int
+	// adminToken unlocks privileged commands (STATUS, ADDITEM, ...) via /admin;
+	// empty disables them.
+	adminToken string
+	// dbPath, when set, is a SQLite database that accepted orders are recorded in.
+	dbPath string
+	// tls enables TLS on the listener when non-nil.
+	tls *tls.Config
+}
+
+// rateLimiter allows at most limit events within any sliding window.
+// It is owned by a single connection goroutine and is not safe for concurrent use.
+type rateLimiter struct {
+	limit  int
+	window time.Duration
+	hits   []time.Time
+}
+
+// allow records an event at now if permitted, otherwise it reports how long
+// until the next event would be.
+func (r *rateLimiter) allow(now time.Time) (bool, time.Duration) {
+	if r.limit <= 0 {
+		return true, 0
+	}
+	cutoff := now.Add(-r.window)
+	kept := r.hits[:0]
+	for _, t := range r.hits {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	r.hits = kept
+	if len(r.hits) >= r.limit {
+		return false, r.hits[0].Sub(cutoff)
+	}
+	r.hits = append(r.hits, now)
+	return true, 0
+}
+
+// nonceTTL is how long the server remembers the ack of an order by nonce.
+const nonceTTL = 5 * time.Minute
+
+// nonceCache holds the acks of recently placed orders by username and
+// nonce. It is shared by all connections, so an order resent after a
+// reconnect is recognized, but one customer's nonce never answers for
+// another's.
+type nonceCache struct {
+	mu      sync.Mutex
+	entries map[string]*nonceEntry
+}
+
+// nonceEntry is an order being placed, or placed, under one nonce. done is
+// closed once ack is set.
+type nonceEntry struct {
+	ack  orderAck
+	at   time.Time
+	done chan struct{}
+}
+
+// orderNonce extracts the nonce from a raw ORDER payload, if any.
+func orderNonce(raw string) string {
+	var ord struct {
+		Nonce string `json:"nonce"`
+	}
+	_ = json.Unmarshal([]byte(raw), &ord)
+	return ord.Nonce
+}
+
+func nonceKey(username, nonce string) string {
+	return username + "\x00" + nonce
+}
+
+// claim returns the entry for key and reports whether the caller created
+// it, in which case it must place the order and call finish. Anyone else
+// waits on the entry's done channel for the ack. Checking and reserving
+// under one lock keeps concurrent resubmissions from both placing the order.
+func (nc *nonceCache) claim(key string, now time.Time) (*nonceEntry, bool) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	if nc.entries == nil {
+		nc.entries = make(map[string]*nonceEntry)
+	}
+	for k, e := range nc.entries {
+		if now.Sub(e.at) > nonceTTL && isClosed(e.done) {
+			delete(nc.entries, k)
+		}
+	}
+	if e, ok := nc.entries[key]; ok {
+		return e, false
+	}
+	e := &nonceEntry{at: now, done: make(chan struct{})}
+	nc.entries[key] = e
+	return e, true
+}
+
+// finish records the ack of a claimed entry and wakes its waiters. Only
+// accepted orders are remembered, so a rejected one can be sent again.
+func (nc *nonceCache) finish(key string, e *nonceEntry, ack orderAck) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
+	e.ack = ack
+	close(e.done)
+	if ack.Status != ackOK && nc.entries[key] == e {
+		delete(nc.entries, key)
+	}
+}
+
+func isClosed(ch chan struct{}) bool {
+	select {
+	case <-ch:
+		return true
+	default:
+		return false
+	}
+}
+
+// rateLimitMessage formats a rejection, rounding the wait up to whole seconds.
+func rateLimitMessage(wait time.Duration) string {
+	return fmt.Sprintf("rate limited, try again in %ds", int((wait+time.Second-1)/time.Second))
 }
 
 // broadcast represents a line to send to all connections with the ability
@@ -33,93 +769,1055 @@ type order struct {
 type broadcast struct {
 	text    string
 	exclude net.Conn
+	// record keeps the line in the history replayed to new connections.
+	record bool
+	// room limits delivery to clients in that room; empty means every room.
+	room string
+}
+
+const (
+	ackOK    = "ok"
+	ackError = "error"
+)
+
+// orderAck is the JSON acknowledgement sent in reply to ORDERV2.
+type orderAck struct {
+	Status   string  `json:"status"`
+	Subtotal float64 `json:"subtotal,omitempty"`
+	Tax      float64 `json:"tax,omitempty"`
+	Discount float64 `json:"discount,omitempty"`
+	Tip      float64 `json:"tip,omitempty"`
+	Total    float64 `json:"total,omitempty"`
+	OrderID  string  `json:"orderId,omitempty"`
+	Message  string  `json:"message,omitempty"`
+	// Nonce echoes the order's nonce, so a client can tell a late ack
+	// for an earlier order from the one it is waiting for.
+	Nonce string `json:"nonce,omitempty"`
+}
+
+func rejectOrder(msg string) orderAck {
+	return orderAck{Status: ackError, Message: msg}
+}
+
+// placeOrder validates and prices a raw ORDER payload, takes it out of
+// stock and broadcasts it to room. Rejections are reported in the returned ack;
+// an accepted order is also returned as HISTORY reports it.
+func (h *Hub) placeOrder(room, connID, raw string) (orderAck, pastOrder) {
+	var ord order
+	if err := json.Unmarshal([]byte(raw), &ord); err != nil {
+		return rejectOrder("invalid order json"), pastOrder{}
+	}
+	ord.Name = strings.TrimSpace(ord.Name)
+	logDebugf("ORDER parsed: name=%q itemId=%q qty=%g items=%d", ord.Name, ord.ItemID, ord.Quantity, len(ord.Items))
+	if ord.Name == "" {
+		return rejectOrder("missing name"), pastOrder{}
+	}
+	if ord.TipPercent < 0 || ord.TipAmount < 0 || (ord.TipPercent > 0 && ord.TipAmount > 0) {
+		return rejectOrder("invalid tip"), pastOrder{}
+	}
+	code := strings.ToUpper(strings.TrimSpace(ord.Coupon))
+	cp, hasCoupon := h.cfg.coupons[code]
+	if code != "" && (!hasCoupon || cp.expired(time.Now())) {
+		return rejectOrder("invalid coupon"), pastOrder{}
+	}
+	// Fallback handling: accept numeric strings or floats for a legacy quantity
+	if len(ord.Items) == 0 && ord.Quantity <= 0 {
+		var generic map[string]any
+		if err := json.Unmarshal([]byte(raw), &generic); err == nil {
+			if v, ok := generic["quantity"]; ok {
+				switch t := v.(type) {
+				case string:
+					if n, err := strconv.ParseFloat(strings.TrimSpace(t), 64); err == nil {
+						ord.Quantity = n
+					}
+				case float64:
+					ord.Quantity = t
+				}
+			}
+		}
+	}
+	orderID, err := gonanoid.Generate(idAlphabet, 8)
+	if err != nil {
+		return rejectOrder("failed to generate order id"), pastOrder{}
+	}
+	lines := ord.lines()
+	for _, ol := range lines {
+		if h.cfg.maxQuantity > 0 && ol.Quantity > float64(h.cfg.maxQuantity) {
+			return rejectOrder("quantity exceeds max"), pastOrder{}
+		}
+	}
+	happy := h.happyHourPercent(time.Now())
+	chosen, reject := h.menu.reserve(lines, happy)
+	if reject != "" {
+		return rejectOrder(reject), pastOrder{}
+	}
+	var (
+		subtotal float64
+		summary  []string
+	)
+	placed := pastOrder{OrderID: orderID, Name: ord.Name}
+	for i, ol := range lines {
+		lineTotal := roundCents(ol.Quantity * chosen[i].Price)
+		subtotal += lineTotal
+		placed.Items = append(placed.Items, pastLine{ItemID: chosen[i].ID, Quantity: ol.Quantity, Total: lineTotal})
+		summary = append(summary, fmt.Sprintf("%s × %s", formatQuantity(ol.Quantity, chosen[i].Unit), chosen[i].Name))
+	}
+	var discount float64
+	if hasCoupon {
+		discount = cp.discount(subtotal)
+	}
+	tax := roundCents((subtotal - discount) * h.cfg.taxRate / 100)
+	tip := roundCents(ord.TipAmount)
+	if ord.TipPercent > 0 {
+		tip = roundCents(subtotal * ord.TipPercent / 100)
+	}
+	total := roundCents(subtotal - discount + tax + tip)
+	price := fmt.Sprintf("$%.2f", total)
+	if happy > 0 {
+		price += fmt.Sprintf(", happy hour -%g%%", happy)
+	}
+	if discount > 0 {
+		price += fmt.Sprintf(", %s -$%.2f", code, discount)
+	}
+
+	now := time.Now()
+	placed.Total, placed.At = total, now.UTC().Truncate(time.Second)
+	audit := orderAudit{
+		OrderID: orderID, Customer: ord.Name, Subtotal: subtotal, Discount: discount, Tax: tax, Tip: tip, Total: total,
+		Coupon: code, HappyHour: happy, At: now.UTC(), ConnID: connID,
+	}
+	for i, ol := range lines {
+		audit.Items = append(audit.Items, auditLine{
+			ItemID: chosen[i].ID, Name: chosen[i].Name, Quantity: ol.Quantity, Modifiers: ol.Modifiers,
+			Price: chosen[i].Price, Total: placed.Items[i].Total,
+		})
+	}
+	if b, err := json.Marshal(audit); err == nil {
+		logInfof("audit: %s", b)
+	}
+	h.status.add(orderID, now)
+	h.ordersServed.Add(1)
+	h.revenueCents.Add(int64(math.Round(total * 100)))
+	h.daily.add(int64(math.Round(total*100)), now)
+	if h.store != nil {
+		if err := h.store.insert(orderID, ord.Name, lines, chosen, now); err != nil {
+			logErrorf("store order %s: %v", orderID, err)
+		}
+	}
+	h.msgCh <- broadcast{
+		text:   stamped("order", fmt.Sprintf("%s ordered %s (%s)", ord.Name, strings.Join(summary, ", "), price)),
+		record: true,
+		room:   room,
+	}
+	return orderAck{Status: ackOK, Subtotal: subtotal, Tax: tax, Discount: discount, Tip: tip, Total: total, OrderID: orderID}, placed
+}
+
+// orderAudit is the audit log record of an accepted order, logged as one
+// line of JSON.
+type orderAudit struct {
+	OrderID   string      `json:"orderId"`
+	Customer  string      `json:"customer"`
+	Items     []auditLine `json:"items"`
+	Subtotal  float64     `json:"subtotal"`
+	Discount  float64     `json:"discount,omitempty"`
+	Tax       float64     `json:"tax,omitempty"`
+	Tip       float64     `json:"tip,omitempty"`
+	Total     float64     `json:"total"`
+	Coupon    string      `json:"coupon,omitempty"`
+	HappyHour float64     `json:"happyHourPercent,omitempty"`
+	At        time.Time   `json:"at"`
+	ConnID    string      `json:"connId"`
+}
+
+// auditLine is one cart line of an orderAudit. Price is the unit price
+// charged, with modifiers and any happy hour applied, and Name includes the
+// chosen modifiers.
+type auditLine struct {
+	ItemID    string              `json:"itemId"`
+	Name      string              `json:"name"`
+	Quantity  float64             `json:"quantity"`
+	Modifiers map[string][]string `json:"modifiers,omitempty"`
+	Price     float64             `json:"price"`
+	Total     float64             `json:"total"`
+}
+
+// pastOrder is an accepted order as HISTORY reports it.
+type pastOrder struct {
+	OrderID string     `json:"orderId"`
+	Name    string     `json:"name"`
+	Items   []pastLine `json:"items"`
+	// Total is what was charged, including tax, tip and discounts. Orders
+	// read back from the database only have their line totals and omit it.
+	Total float64   `json:"total,omitempty"`
+	At    time.Time `json:"at"`
+}
+
+// pastLine is one cart line of a pastOrder; Total is quantity × price.
+type pastLine struct {
+	ItemID   string  `json:"itemId"`
+	Quantity float64 `json:"quantity"`
+	Total    float64 `json:"total"`
+}
+
+// historyLimit caps how many orders HISTORY returns, keeping the newest.
+const historyLimit = 50
+
+func roundCents(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// orderStore records accepted orders in SQLite, one row per cart line with
+// that line's total. Writes are serialized by mu.
+type orderStore struct {
+	mu sync.Mutex
+	db *sql.DB
+}
+
+func openOrderStore(path string) (*orderStore, error) {
+	db, err := sql.Open("sqlite", path)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(1)
+	_, err = db.Exec(`CREATE TABLE IF NOT EXISTS orders (
+		id        TEXT NOT NULL,
+		name      TEXT NOT NULL,
+		item_id   TEXT NOT NULL,
+		quantity  INTEGER NOT NULL,
+		total     REAL NOT NULL,
+		timestamp TEXT NOT NULL
+	)`)
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("create orders table: %w", err)
+	}
+	return &orderStore{db: db}, nil
+}
+
+// insert records an order's lines; items holds the menu item for each line.
+func (s *orderStore) insert(id, name string, lines []orderLine, items []menuItem, at time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	ts := at.UTC().Format(time.RFC3339)
+	for i, ol := range lines {
+		total := roundCents(ol.Quantity * items[i].Price)
+		if _, err := tx.Exec(`INSERT INTO orders (id, name, item_id, quantity, total, timestamp) VALUES (?, ?, ?, ?, ?, ?)`,
+			id, name, items[i].ID, ol.Quantity, total, ts); err != nil {
+			_ = tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// ordersByName returns the newest historyLimit orders placed under name,
+// oldest first.
+func (s *orderStore) ordersByName(name string) ([]pastOrder, error) {
+	rows, err := s.db.Query(`SELECT id, item_id, quantity, total, timestamp FROM orders WHERE name = ? ORDER BY timestamp, rowid`, name)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var (
+		orders []pastOrder
+		index  = map[string]int{}
+	)
+	for rows.Next() {
+		var (
+			id, ts string
+			line   pastLine
+		)
+		if err := rows.Scan(&id, &line.ItemID, &line.Quantity, &line.Total, &ts); err != nil {
+			return nil, err
+		}
+		i, ok := index[id]
+		if !ok {
+			at, err := time.Parse(time.RFC3339, ts)
+			if err != nil {
+				return nil, fmt.Errorf("order %s: %w", id, err)
+			}
+			i = len(orders)
+			index[id] = i
+			orders = append(orders, pastOrder{OrderID: id, Name: name, At: at})
+		}
+		orders[i].Items = append(orders[i].Items, line)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return lastN(orders, historyLimit), nil
+}
+
+// lastN returns the last n elements of s.
+func lastN[T any](s []T, n int) []T {
+	if len(s) > n {
+		return s[len(s)-n:]
+	}
+	return s
+}
+
+func (s *orderStore) Close() error {
+	return s.db.Close()
+}
+
+// Order states, in the order an order moves through them.
+const (
+	stateReceived  = "received"
+	statePreparing = "preparing"
+	stateReady     = "ready"
+)
+
+var orderStates = []string{stateReceived, statePreparing, stateReady}
+
+// statusTTL is how long an order that is never made ready stays on the
+// status board after its last change, e.g. one abandoned at the counter.
+const statusTTL = 12 * time.Hour
+
+// statusBoard tracks the state of accepted orders until they are ready or
+// have not changed for statusTTL.
+type statusBoard struct {
+	mu     sync.Mutex
+	states map[string]orderState
+}
+
+// orderState is an order's state on the board and when it was set.
+type orderState struct {
+	state string
+	at    time.Time
+}
+
+func newStatusBoard() *statusBoard {
+	return &statusBoard{states: make(map[string]orderState)}
+}
+
+// add puts a new order on the board, dropping orders that have not changed
+// for statusTTL.
+func (b *statusBoard) add(orderID string, now time.Time) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for id, st := range b.states {
+		if now.Sub(st.at) > statusTTL {
+			delete(b.states, id)
+		}
+	}
+	b.states[orderID] = orderState{state: stateReceived, at: now}
+}
+
+// advance moves an order to state, which must directly follow its current
+// one. Ready orders are forgotten. It returns a rejection reason, or "".
+func (b *statusBoard) advance(orderID, state string, now time.Time) string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !slices.Contains(orderStates, state) {
+		return "invalid state"
+	}
+	cur, ok := b.states[orderID]
+	if !ok || now.Sub(cur.at) > statusTTL {
+		return "unknown order"
+	}
+	if next := slices.Index(orderStates, cur.state) + 1; next >= len(orderStates) || orderStates[next] != state {
+		return fmt.Sprintf("cannot change order from %s to %s", cur.state, state)
+	}
+	if state == stateReady {
+		delete(b.states, orderID)
+	} else {
+		b.states[orderID] = orderState{state: state, at: now}
+	}
+	return ""
+}
+
+// stamped formats a tagged broadcast line with the current UTC time,
+// e.g. "[order]|2024-01-02T15:04:05Z|alice ordered ...".
+func stamped(tag, body string) string {
+	return fmt.Sprintf("[%s]|%s|%s", tag, time.Now().UTC().Format(time.RFC3339), body)
+}
+
+// ring is a fixed-size ring buffer of the most recent values. The server
+// keeps its order history in one and the client its feed panels.
+type ring[T any] struct {
+	buf   []T
+	start int
+	n     int
+}
+
+func newRing[T any](size int) *ring[T] {
+	if size < 0 {
+		size = 0
+	}
+	return &ring[T]{buf: make([]T, size)}
+}
+
+func (r *ring[T]) push(v T) {
+	if len(r.buf) == 0 {
+		return
+	}
+	if r.n < len(r.buf) {
+		r.buf[(r.start+r.n)%len(r.buf)] = v
+		r.n++
+		return
+	}
+	r.buf[r.start] = v
+	r.start = (r.start + 1) % len(r.buf)
+}
+
+// items returns the buffered values, oldest first.
+func (r *ring[T]) items() []T {
+	out := make([]T, 0, r.n)
+	for i := 0; i < r.n; i++ {
+		out = append(out, r.buf[(r.start+i)%len(r.buf)])
+	}
+	return out
+}
+
+func (r *ring[T]) len() int { return r.n }
+
+// clear empties the buffer, keeping its size.
+func (r *ring[T]) clear() {
+	clear(r.buf)
+	r.start, r.n = 0, 0
+}
+
+const (
+	// outboxSize is how many broadcasts may queue for a connection before
+	// it is considered too slow and evicted.
+	outboxSize = 256
+	// writeTimeout bounds each socket write so a stalled peer cannot wedge
+	// its writer goroutine.
+	writeTimeout = 5 * time.Second
+	// writeBufferSize is how much of a burst of broadcasts a connection's
+	// writer gathers into one socket write.
+	writeBufferSize = 16 * 1024
+	// pongTimeout is how long after a heartbeat interval a client may take
+	// to answer PING before it is dropped.
+	pongTimeout = 10 * time.Second
+)
+
+// client is the hub's view of a single connection.
+type client struct {
+	conn     net.Conn
+	id       string
+	username string
+	// room is the room the client receives broadcasts for; guarded by Hub.mu.
+	room string
+	// out queues broadcast lines for writeLoop; sends happen under Hub.mu.
+	out chan string
+	// lastSeen is when the client last sent anything (UnixNano), used by the heartbeat.
+	lastSeen atomic.Int64
+	// kicked is set by Hub.kick; the [kick] broadcast then stands in for [leave].
+	kicked atomic.Bool
+}
+
+func (cl *client) touch() {
+	cl.lastSeen.Store(time.Now().UnixNano())
+}
+
+// writeLoop delivers queued lines until out is closed, then closes the
+// connection. Lines queued together are buffered and flushed once the queue
+// is empty, so a burst costs a few socket writes instead of one per line. A
+// failed write closes the connection, which ends its handleConn and leaves
+// the hub.
+//
+// Replies to the client's own requests, like order acks, are written by
+// handleConn straight to the connection and are not held up here.
+func (cl *client) writeLoop() {
+	w := bufio.NewWriterSize(cl.conn, writeBufferSize)
+	for line := range cl.out {
+		_ = cl.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+		writeLine(w, line)
+	drain:
+		for {
+			select {
+			case next, ok := <-cl.out:
+				if !ok {
+					break drain
+				}
+				writeLine(w, next)
+			default:
+				break drain
+			}
+		}
+		if err := w.Flush(); err != nil {
+			_ = cl.conn.Close()
+		}
+	}
+	_ = cl.conn.Close()
+}
+
+// writeLine buffers line in w, flushing first if it would not fit. Every
+// socket write then holds whole lines, so replies written directly to the
+// connection in between never land in the middle of one.
+func writeLine(w *bufio.Writer, line string) {
+	if w.Buffered() > 0 && w.Available() < len(line)+1 {
+		_ = w.Flush()
+	}
+	_, _ = fmt.Fprintln(w, line)
 }
 
 // Hub manages the set of connected clients and fan-out of messages.
 type Hub struct {
 	mu      sync.Mutex
-	conns   map[net.Conn]struct{}
-	joinCh  chan net.Conn
+	conns   map[net.Conn]*client
+	joinCh  chan *client
 	leaveCh chan net.Conn
 	msgCh   chan broadcast
+	// history holds each room's recent orders, created on first use.
+	history map[string]*ring[string]
+	menu    *menuStore
+	status  *statusBoard
+	done    chan struct{}
+	cfg     serverConfig
+	// store, when non-nil, records accepted orders.
+	store *orderStore
+
+	// Counters reported by STATS.
+	startedAt    time.Time
+	connected    atomic.Int64
+	ordersServed atomic.Int64
+	revenueCents atomic.Int64
+	// droppedBroadcasts counts chat lines dropped because msgCh was full.
+	droppedBroadcasts atomic.Int64
+	// daily counts today's orders for TOTALS and [summary].
+	daily dailyTotals
+	// nonces remembers the acks of recent orders for resubmissions.
+	nonces nonceCache
+
+	// seq numbers every broadcast; replay keeps the latest for REPLAY.
+	seq    uint64
+	replay *ring[sequenced]
+}
+
+// sequenced is a broadcast as sent, with its sequence number and room.
+type sequenced struct {
+	seq  uint64
+	room string
+	text string
+}
+
+// replaySince returns the retained broadcasts after seq that room saw,
+// oldest first, and the number of the latest broadcast. A latest below seq
+// means the server restarted since seq was sent.
+func (h *Hub) replaySince(room string, seq uint64) ([]string, uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var out []string
+	for _, b := range h.replay.items() {
+		if b.seq > seq && (b.room == "" || b.room == room) {
+			out = append(out, b.text)
+		}
+	}
+	return out, h.seq
+}
+
+// dailyTotals counts orders and revenue since local midnight, starting
+// over when the day changes.
+type dailyTotals struct {
+	mu           sync.Mutex
+	day          time.Time
+	orders       int64
+	revenueCents int64
 }
 
-func NewHub() *Hub {
+func midnight(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+// rollLocked starts a new day's counts once now is past the current day.
+func (d *dailyTotals) rollLocked(now time.Time) {
+	if day := midnight(now); !day.Equal(d.day) {
+		d.day, d.orders, d.revenueCents = day, 0, 0
+	}
+}
+
+func (d *dailyTotals) add(cents int64, now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rollLocked(now)
+	d.orders++
+	d.revenueCents += cents
+}
+
+func (d *dailyTotals) get(now time.Time) (day time.Time, orders, cents int64) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.rollLocked(now)
+	return d.day, d.orders, d.revenueCents
+}
+
+// hubTotals is the JSON reply to TOTALS: orders and revenue (grand totals)
+// since Since, the later of local midnight and server start.
+type hubTotals struct {
+	Since   time.Time `json:"since"`
+	Orders  int64     `json:"orders"`
+	Revenue float64   `json:"revenue"`
+}
+
+func (h *Hub) totals(now time.Time) hubTotals {
+	day, orders, cents := h.daily.get(now)
+	if h.startedAt.After(day) {
+		day = h.startedAt
+	}
+	return hubTotals{Since: day, Orders: orders, Revenue: float64(cents) / 100}
+}
+
+// hubStats is the JSON reply to STATS.
+type hubStats struct {
+	Connections       int64   `json:"connections"`
+	Orders            int64   `json:"orders"`
+	Revenue           float64 `json:"revenue"`
+	UptimeSeconds     int64   `json:"uptimeSeconds"`
+	DroppedBroadcasts int64   `json:"droppedBroadcasts"`
+}
+
+func (h *Hub) stats() hubStats {
+	return hubStats{
+		Connections:       h.connected.Load(),
+		Orders:            h.ordersServed.Load(),
+		Revenue:           float64(h.revenueCents.Load()) / 100,
+		UptimeSeconds:     int64(time.Since(h.startedAt).Seconds()),
+		DroppedBroadcasts: h.droppedBroadcasts.Load(),
+	}
+}
+
+// tryBroadcast queues a non-critical broadcast such as chat without
+// blocking: when msgCh is full the line is dropped and counted, so a flood
+// of chat cannot stall the sender's connection. Orders, renames and
+// presence changes still use a blocking send and are never dropped.
+func (h *Hub) tryBroadcast(msg broadcast) {
+	select {
+	case h.msgCh <- msg:
+	default:
+		// Log the first drop and then every 100th, not the whole flood.
+		if n := h.droppedBroadcasts.Add(1); n == 1 || n%100 == 0 {
+			logErrorf("broadcast queue full, dropped chat line (%d dropped so far)", n)
+		}
+	}
+}
+
+func NewHub(cfg serverConfig) *Hub {
 	return &Hub{
-		conns:   make(map[net.Conn]struct{}),
-		joinCh:  make(chan net.Conn),
+		conns:   make(map[net.Conn]*client),
+		joinCh:  make(chan *client),
 		leaveCh: make(chan net.Conn),
-		msgCh:   make(chan broadcast, 128),
+		msgCh:   make(chan broadcast, max(cfg.broadcastBuffer, 1)),
+		history: make(map[string]*ring[string]),
+		replay:  newRing[sequenced](cfg.replaySize),
+		menu:    newMenuStore(cfg.menu),
+		status:  newStatusBoard(),
+		done:    make(chan struct{}),
+		cfg:     cfg,
+
+		startedAt: time.Now(),
 	}
 }
 
+// Stop makes Run close all connections and return.
+func (h *Hub) Stop() {
+	close(h.done)
+}
+
 func (h *Hub) Run() {
+	var ping, summary <-chan time.Time
+	if h.cfg.heartbeat > 0 {
+		t := time.NewTicker(h.cfg.heartbeat)
+		defer t.Stop()
+		ping = t.C
+	}
+	if h.cfg.summaryInterval > 0 {
+		t := time.NewTicker(h.cfg.summaryInterval)
+		defer t.Stop()
+		summary = t.C
+	}
 	for {
 		select {
-		case c := <-h.joinCh:
+		case <-ping:
 			h.mu.Lock()
-			h.conns[c] = struct{}{}
+			h.pingLocked()
 			h.mu.Unlock()
-		case c := <-h.leaveCh:
+		case now := <-summary:
+			t := h.totals(now)
 			h.mu.Lock()
-			if _, ok := h.conns[c]; ok {
-				delete(h.conns, c)
-				_ = c.Close()
-			}
+			h.fanOutLocked(broadcast{text: stamped("summary", fmt.Sprintf("%d orders today, $%.2f", t.Orders, t.Revenue))})
 			h.mu.Unlock()
-		case msg := <-h.msgCh:
+		case <-h.done:
 			h.mu.Lock()
 			for c := range h.conns {
-				if msg.exclude != nil && c == msg.exclude {
-					continue
-				}
-				// Newline-delimited messages
-				fmt.Fprintln(c, msg.text)
+				h.removeLocked(c)
 			}
 			h.mu.Unlock()
+			return
+		case cl := <-h.joinCh:
+			h.mu.Lock()
+			// Replay recent orders before registering so the new connection
+			// neither misses nor duplicates a concurrent broadcast.
+			history := h.historyLocked(cl.room).items()
+			cl.out = make(chan string, outboxSize+len(history))
+			for _, line := range history {
+				cl.out <- line
+			}
+			h.conns[cl.conn] = cl
+			h.connected.Add(1)
+			go cl.writeLoop()
+			h.mu.Unlock()
+		case c := <-h.leaveCh:
+			h.mu.Lock()
+			h.removeLocked(c)
+			h.mu.Unlock()
+		case msg := <-h.msgCh:
+			h.mu.Lock()
+			h.fanOutLocked(msg)
+			h.mu.Unlock()
+		}
+	}
+}
+
+// fanOutLocked numbers msg and queues it for its recipients, e.g.
+// "#42 [order]|...". h.mu must be held.
+func (h *Hub) fanOutLocked(msg broadcast) {
+	h.seq++
+	msg.text = fmt.Sprintf("#%d %s", h.seq, msg.text)
+	h.replay.push(sequenced{seq: h.seq, room: msg.room, text: msg.text})
+	if msg.record {
+		h.historyLocked(msg.room).push(msg.text)
+	}
+	for c, cl := range h.conns {
+		if msg.exclude != nil && c == msg.exclude {
+			continue
+		}
+		if msg.room != "" && cl.room != msg.room {
+			continue
+		}
+		// Enqueue without blocking; a full outbox means the client
+		// cannot keep up, so drop it rather than stall everyone.
+		select {
+		case cl.out <- msg.text:
+		default:
+			logInfof("evict: slow client user=%s id=%s remote=%s", cl.username, cl.id, c.RemoteAddr())
+			h.removeLocked(c)
+		}
+	}
+}
+
+// historyLocked returns room's order history. h.mu must be held.
+func (h *Hub) historyLocked(room string) *ring[string] {
+	r, ok := h.history[room]
+	if !ok {
+		r = newRing[string](h.cfg.historySize)
+		h.history[room] = r
+	}
+	return r
+}
+
+// moveRoom switches cl to room and replays that room's recent orders.
+func (h *Hub) moveRoom(cl *client, room string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.conns[cl.conn]; !ok {
+		return
+	}
+	cl.room = room
+	for _, line := range h.historyLocked(room).items() {
+		select {
+		case cl.out <- line:
+		default:
+			// Like fanOutLocked, evict rather than leave gaps in the history.
+			logInfof("evict: slow client user=%s id=%s remote=%s", cl.username, cl.id, cl.conn.RemoteAddr())
+			h.removeLocked(cl.conn)
+			return
+		}
+	}
+}
+
+// pingLocked drops clients that have not answered the previous PING in time
+// and sends a fresh PING to the rest. h.mu must be held.
+func (h *Hub) pingLocked() {
+	deadline := time.Now().Add(-(h.cfg.heartbeat + pongTimeout)).UnixNano()
+	for c, cl := range h.conns {
+		if cl.lastSeen.Load() < deadline {
+			logInfof("heartbeat: no PONG from user=%s id=%s remote=%s", cl.username, cl.id, c.RemoteAddr())
+			h.removeLocked(c)
+			continue
+		}
+		select {
+		case cl.out <- "PING":
+		default:
+			h.removeLocked(c)
+		}
+	}
+}
+
+// removeLocked unregisters and closes a connection. h.mu must be held.
+func (h *Hub) removeLocked(c net.Conn) {
+	if h.detachLocked(c) {
+		_ = c.Close()
+	}
+}
+
+// detachLocked removes c from the hub and closes its queue, leaving
+// writeLoop to deliver what is queued and then close the connection.
+func (h *Hub) detachLocked(c net.Conn) bool {
+	cl, ok := h.conns[c]
+	if !ok {
+		return false
+	}
+	delete(h.conns, c)
+	h.connected.Add(-1)
+	close(cl.out)
+	return true
+}
+
+// setUsername records a connection's new username. It reports false, leaving
+// the name unchanged, if another client already uses it.
+func (h *Hub) setUsername(cl *client, username string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, other := range h.conns {
+		if other != cl && other.username == username {
+			return false
+		}
+	}
+	cl.username = username
+	return true
+}
+
+// privateMessage delivers text from one client to the first client named to,
+// echoing it back to the sender. It reports false if no such user is connected.
+func (h *Hub) privateMessage(from *client, to, text string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var target *client
+	for _, cl := range h.conns {
+		if cl.username == to {
+			target = cl
+			break
+		}
+	}
+	if target == nil {
+		return false
+	}
+	line := fmt.Sprintf("[pm] %s -> %s: %s", from.username, target.username, text)
+	for _, cl := range []*client{target, from} {
+		if _, ok := h.conns[cl.conn]; !ok {
+			continue
+		}
+		select {
+		case cl.out <- line:
+		default:
+			h.removeLocked(cl.conn)
+		}
+		if target == from {
+			break
+		}
+	}
+	return true
+}
+
+// clearHistory empties every room's order history and the REPLAY buffer,
+// then tells everyone the feed was cleared.
+func (h *Hub) clearHistory() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, r := range h.history {
+		r.clear()
+	}
+	h.replay.clear()
+	h.fanOutLocked(broadcast{text: stamped("server", "feed cleared")})
+}
+
+// kick tells the first client named username it was kicked and disconnects
+// it. It returns the client's ID and room, or false if no such client is
+// connected.
+func (h *Hub) kick(username string) (id, room string, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for c, cl := range h.conns {
+		if cl.username != username {
+			continue
+		}
+		cl.kicked.Store(true)
+		// The notice goes out after anything already queued, then writeLoop
+		// closes the connection. A client too far behind to take it is
+		// dropped without it.
+		select {
+		case cl.out <- "[info] you were kicked":
+		default:
+		}
+		h.detachLocked(c)
+		return cl.id, cl.room, true
+	}
+	return "", "", false
+}
+
+// usernames returns the sorted usernames of the clients in room.
+func (h *Hub) usernames(room string) []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	names := make([]string, 0, len(h.conns))
+	for _, cl := range h.conns {
+		if cl.room != room {
+			continue
+		}
+		names = append(names, cl.username)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// helpLines describes the commands handleConn understands, in reply to /help.
+var helpLines = []string{
+	"MENU                      menu as a JSON array",
+	"ITEM <id>                 one menu item as JSON, e.g. to check its stock",
+	"ORDER <json>              place an order; reply OK|<total>|<orderId> or [error] <reason>",
+	"ORDERV2 <json>            place an order; reply is a JSON ack",
+	"STATUS <orderId> <state>  advance an order: received -> preparing -> ready (admin)",
+	"ADDITEM <json>            add a menu item (admin)",
+	"DELITEM <id>              remove a menu item (admin)",
+	"SETPRICE <id> <price>     change a menu item's price (admin)",
+	"STATS                     server counters as JSON",
+	"TOTALS                    today's orders and revenue as JSON",
+	"HISTORY                   your orders as a JSON array; with -db, all under your username",
+	"REPLAY <seq>              resend recent broadcasts numbered after #<seq>",
+	"PING                      reply PONG",
+	"HEALTH                    reply OK; as the first line, without a greeting",
+	"/name <username>          change your username",
+	"/whoami                   show your username and id",
+	"/list                     list users in your room",
+	"/msg <username> <text>    send a private message",
+	"/me <action>              tell everyone what you are doing",
+	"/admin <token>            enable admin commands",
+	"/kick <username>          disconnect a user (admin)",
+	"/clear                    empty the order history and REPLAY buffer (admin)",
+	"/help                     show this help",
+	"/join <room>              switch rooms; chat and orders stay within a room",
+	"/quit                     disconnect",
+	"anything else is sent to everyone as chat",
+}
+
+// sanitize trims s and maps its runes through mapping, dropping those mapped
+// to -1 as strings.Map does. At most maxLen runes are kept when maxLen > 0.
+func sanitize(s string, maxLen int, mapping func(rune) rune) string {
+	var out []rune
+	for _, r := range strings.TrimSpace(s) {
+		if r = mapping(r); r < 0 {
+			continue
+		}
+		out = append(out, r)
+		if maxLen > 0 && len(out) >= maxLen {
+			break
 		}
 	}
+	return string(out)
 }
 
-// sanitizeUsername enforces server rules on allowed usernames.
-// - letters, digits, '_', '-', '.' allowed
+// maxUsernameLen caps usernames and room names. The client's order form holds
+// customer names to it too.
+const maxUsernameLen = 12
+
+// sanitizeUsername enforces server rules on allowed usernames and room names.
+// - letters and digits of any script (José, Zoë), '_', '-', '.' allowed
 // - spaces converted to '_'
+// - anything else dropped: emoji, punctuation, control characters
 // - trimmed of leading/trailing '.', '_' or '-'
 // - empty after sanitization is invalid
-// - max length limited
+// - max length limited, in runes
 func sanitizeUsername(s string) string {
-	s = strings.TrimSpace(s)
-	if s == "" {
-		return ""
-	}
-	const maxLen = 12
-	var out []rune
-	for _, r := range s {
+	return strings.Trim(sanitize(s, maxUsernameLen, func(r rune) rune {
 		switch {
-		case r >= 'a' && r <= 'z',
-			r >= 'A' && r <= 'Z',
-			r >= '0' && r <= '9',
+		case unicode.IsLetter(r), unicode.IsNumber(r),
 			r == '_', r == '-', r == '.':
-			out = append(out, r)
+			return r
 		case r == ' ':
-			out = append(out, '_')
-		default:
-			// skip everything else
+			return '_'
 		}
-		if len(out) >= maxLen {
-			break
+		return -1
+	}), "._-")
+}
+
+// sanitizeChat strips control and other non-printable characters from chat
+// text; tabs become spaces.
+func sanitizeChat(s string) string {
+	return strings.TrimSpace(sanitize(s, 0, func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if !unicode.IsPrint(r) {
+			return -1
+		}
+		return r
+	}))
+}
+
+// chatText sanitizes chat text from c. It reports false, after telling the
+// client, when the text is longer than the -max-chat limit.
+func (h *Hub) chatText(c net.Conn, s string) (string, bool) {
+	s = sanitizeChat(s)
+	if h.cfg.maxChat > 0 && utf8.RuneCountInString(s) > h.cfg.maxChat {
+		fmt.Fprintf(c, "[error] message too long (max %d characters)\n", h.cfg.maxChat)
+		return "", false
+	}
+	return s, true
+}
+
+// healthWait is how long a new TCP connection has to send HEALTH before it is
+// greeted as a client.
+const healthWait = 50 * time.Millisecond
+
+// answerHealth answers a HEALTH probe sent as a connection's first line with
+// OK and closes it, before the connection is greeted, counted against
+// maxConns or joined to the hub, so probes get an answer even when the hub
+// is busy and do not show up as joins and leaves. Otherwise it returns the
+// connection to serve, with anything already read kept for handleConn.
+func answerHealth(c net.Conn) (net.Conn, bool) {
+	if tc, ok := c.(*tls.Conn); ok {
+		_ = tc.SetDeadline(time.Now().Add(writeTimeout))
+		if err := tc.Handshake(); err != nil {
+			logDebugf("tls handshake with %s: %v", c.RemoteAddr(), err)
+			_ = c.Close()
+			return c, true
 		}
+		_ = tc.SetDeadline(time.Time{})
+	}
+	br := bufio.NewReader(c)
+	_ = c.SetReadDeadline(time.Now().Add(healthWait))
+	// Peek clears the timeout, so later reads go on as usual.
+	first, _ := br.Peek(len("HEALTH\r\n"))
+	_ = c.SetReadDeadline(time.Time{})
+	if bytes.HasPrefix(first, []byte("HEALTH\n")) || bytes.HasPrefix(first, []byte("HEALTH\r\n")) {
+		_ = c.SetWriteDeadline(time.Now().Add(writeTimeout))
+		fmt.Fprintln(c, "OK")
+		_ = c.Close()
+		return c, true
 	}
-	res := strings.Trim(string(out), "._-")
-	return res
+	if br.Buffered() == 0 {
+		return c, false
+	}
+	return &bufferedConn{Conn: c, r: br}, false
+}
+
+// bufferedConn is a connection whose reads go through r, which holds bytes
+// already read from it.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
 }
 
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
 func handleConn(h *Hub, c net.Conn) {
-	defer func() { h.leaveCh <- c }()
-	h.joinCh <- c
+	defer func() {
+		select {
+		case h.leaveCh <- c:
+		case <-h.done:
+			_ = c.Close()
+		}
+	}()
 
 	// Generate per-connection ID
-	id, err := gonanoid.Generate("abcdef0123456789", 6)
+	id, err := gonanoid.Generate(idAlphabet, 6)
 	if err != nil || id == "" {
 		// Fallback to remote addr if generation fails
 		id = c.RemoteAddr().String()
@@ -131,25 +1829,123 @@ func handleConn(h *Hub, c net.Conn) {
 
 	// Greet client and instruct on setting username
 	fmt.Fprintf(c, "Welcome %s (%s)\n", username, id)
-	fmt.Fprintln(c, "Use /name <username> to set your username. Allowed: [A-Za-z0-9_.-] (spaces become _)")
+	greeting := h.cfg.greeting
+	if greeting == "" {
+		greeting = defaultGreeting
+	}
+	fmt.Fprintln(c, strings.NewReplacer("{username}", username, "{id}", id).Replace(greeting))
+	// Register after the greeting; the hub replays recent orders on join.
+	room := defaultRoom
+	self := &client{conn: c, id: id, username: username, room: room}
+	self.touch()
+	select {
+	case h.joinCh <- self:
+	case <-h.done:
+		return
+	}
 	// Announce join to others, exclude self
-	log.Printf("join: user=%s id=%s remote=%s", username, id, c.RemoteAddr())
-	h.msgCh <- broadcast{text: fmt.Sprintf("[join] %s (%s)", username, id), exclude: c}
+	logInfof("join: user=%s id=%s remote=%s", username, id, c.RemoteAddr())
+	h.msgCh <- broadcast{text: stamped("join", fmt.Sprintf("%s (%s)", username, id)), exclude: c, room: room}
+
+	limiter := &rateLimiter{limit: h.cfg.orderLimit, window: h.cfg.orderWindow}
+	// placed holds this connection's accepted orders for HISTORY.
+	var placed []pastOrder
+	// place places a raw ORDER payload within the rate limit.
+	place := func(now time.Time, raw string) orderAck {
+		if ok, wait := limiter.allow(now); !ok {
+			return rejectOrder(rateLimitMessage(wait))
+		}
+		ack, po := h.placeOrder(room, id, raw)
+		if ack.Status == ackOK {
+			placed = lastN(append(placed, po), historyLimit)
+		}
+		return ack
+	}
+	// placeOrder is place, except that a nonce this user already sent gets
+	// the original ack, without placing the order again.
+	placeOrder := func(raw string) orderAck {
+		now := time.Now()
+		nonce := orderNonce(raw)
+		if nonce == "" {
+			return place(now, raw)
+		}
+		key := nonceKey(username, nonce)
+		e, owner := h.nonces.claim(key, now)
+		if !owner {
+			<-e.done
+			logInfof("ORDER duplicate nonce=%s order=%s user=%s id=%s", nonce, e.ack.OrderID, username, id)
+			return e.ack
+		}
+		ack := place(now, raw)
+		h.nonces.finish(key, e, ack)
+		return ack
+	}
+	admin := false
 
 	scanner := bufio.NewScanner(c)
 	// Allow reasonably large lines
 	scanner.Buffer(make([]byte, 0, 1024), 64*1024)
 
-	for scanner.Scan() {
+	// The read deadline is pushed forward on every line but heartbeats, so it
+	// expires after idleTimeout without anything else from the client.
+	idle := h.cfg.idleTimeout
+	if idle > 0 {
+		_ = c.SetReadDeadline(time.Now().Add(idle))
+	}
+
+	scan := func() bool {
+		if !scanner.Scan() {
+			return false
+		}
+		self.touch()
+		if idle > 0 && !isHeartbeat(scanner.Text()) {
+			_ = c.SetReadDeadline(time.Now().Add(idle))
+		}
+		return true
+	}
+	// orderPayload returns the JSON after ORDER or ORDERV2, which may also
+	// come on the next line after the bare keyword.
+	orderPayload := func(raw string) (string, bool) {
+		if raw = strings.TrimSpace(raw); raw != "" {
+			return raw, true
+		}
+		if !scan() {
+			return "", false
+		}
+		return strings.TrimSpace(scanner.Text()), true
+	}
+
+	for scan() {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
 			continue
 		}
 
+		// PONG answers the hub's heartbeat PING; nothing else to do.
+		if strings.EqualFold(line, "PONG") {
+			continue
+		}
+		// PING from a client is a latency probe; answer it directly.
+		if line == "PING" {
+			fmt.Fprintln(c, "PONG")
+			continue
+		}
+		// HEALTH is normally answered by answerHealth as the first line of a
+		// TCP connection; later, or over WebSocket, it is answered here.
+		if line == "HEALTH" {
+			fmt.Fprintln(c, "OK")
+			continue
+		}
+
 		// New protocol commands:
 		// MENU -> server returns single-line JSON array of menuItem
 		if strings.EqualFold(line, "MENU") {
-			b, err := json.Marshal(serverMenu)
+			menu := h.menu.snapshot(h.happyHourPercent(time.Now()))
+			if len(menu) == 0 {
+				fmt.Fprintln(c, "[error] menu is empty")
+				continue
+			}
+			b, err := json.Marshal(menu)
 			if err != nil {
 				fmt.Fprintln(c, `[error] failed to encode menu`)
 				continue
@@ -158,59 +1954,200 @@ func handleConn(h *Hub, c net.Conn) {
 			continue
 		}
 
-		// ORDER <json> -> server validates and replies with a single-line ack
-		if strings.HasPrefix(line, "ORDER") {
-			raw := strings.TrimSpace(line[len("ORDER"):])
-			var ord order
-			if err := json.Unmarshal([]byte(raw), &ord); err != nil {
-				fmt.Fprintln(c, "[error] invalid order json")
-				continue
-			}
-			ord.Name = strings.TrimSpace(ord.Name)
-			log.Printf("ORDER parsed: name=%q itemId=%q qty=%d", ord.Name, ord.ItemID, ord.Quantity)
-			if ord.Name == "" {
-				fmt.Fprintln(c, "[error] missing name")
-				continue
-			}
-			// Fallback handling: accept numeric strings or floats for quantity
-			if ord.Quantity <= 0 {
-				var generic map[string]any
-				if err := json.Unmarshal([]byte(raw), &generic); err == nil {
-					if v, ok := generic["quantity"]; ok {
-						switch t := v.(type) {
-						case string:
-							if n, err := strconv.Atoi(strings.TrimSpace(t)); err == nil {
-								ord.Quantity = n
-							}
-						case float64:
-							ord.Quantity = int(t)
-						}
-					}
-				}
+		// ITEM <id> -> single-line JSON of one menuItem
+		if rest, ok := strings.CutPrefix(line, "ITEM "); ok {
+			it, found := h.menu.item(strings.TrimSpace(rest), h.happyHourPercent(time.Now()))
+			if !found {
+				fmt.Fprintln(c, "[error] unknown item")
+				continue
+			}
+			b, err := json.Marshal(it)
+			if err != nil {
+				fmt.Fprintln(c, `[error] failed to encode item`)
+				continue
+			}
+			fmt.Fprintln(c, string(b))
+			continue
+		}
+
+		// REPLAY <seq> -> the retained broadcasts after seq, then a count
+		if rest, ok := strings.CutPrefix(line, "REPLAY "); ok {
+			since, err := strconv.ParseUint(strings.TrimPrefix(strings.TrimSpace(rest), "#"), 10, 64)
+			if err != nil {
+				fmt.Fprintln(c, "[error] invalid sequence")
+				continue
 			}
-			if ord.Quantity <= 0 {
-				fmt.Fprintln(c, "[error] invalid quantity")
+			lines, latest := h.replaySince(room, since)
+			for _, l := range lines {
+				fmt.Fprintln(c, l)
+			}
+			fmt.Fprintf(c, "[info] replayed %d, latest #%d\n", len(lines), latest)
+			continue
+		}
+
+		// HISTORY -> single-line JSON array of this connection's orders, or
+		// with -db of every stored order under the username
+		if line == "HISTORY" || strings.HasPrefix(line, "HISTORY ") {
+			if line != "HISTORY" {
+				fmt.Fprintln(c, "[error] usage: HISTORY")
 				continue
 			}
-			var chosen *menuItem
-			for i := range serverMenu {
-				if serverMenu[i].ID == ord.ItemID {
-					chosen = &serverMenu[i]
-					break
+			orders := []pastOrder{}
+			if h.store != nil {
+				found, err := h.store.ordersByName(username)
+				if err != nil {
+					logErrorf("history for %q: %v", username, err)
+					fmt.Fprintln(c, "[error] failed to load history")
+					continue
 				}
+				orders = append(orders, found...)
+			} else {
+				orders = append(orders, placed...)
 			}
-			if chosen == nil {
-				fmt.Fprintln(c, "[error] unknown item")
+			b, err := json.Marshal(orders)
+			if err != nil {
+				fmt.Fprintln(c, `[error] failed to encode history`)
+				continue
+			}
+			fmt.Fprintln(c, string(b))
+			continue
+		}
+
+		// TOTALS -> single-line JSON with today's order count and revenue
+		if strings.EqualFold(line, "TOTALS") {
+			b, err := json.Marshal(h.totals(time.Now()))
+			if err != nil {
+				fmt.Fprintln(c, `[error] failed to encode totals`)
+				continue
+			}
+			fmt.Fprintln(c, string(b))
+			continue
+		}
+
+		// STATS -> single-line JSON with connection, order and uptime counters
+		if strings.EqualFold(line, "STATS") {
+			b, err := json.Marshal(h.stats())
+			if err != nil {
+				fmt.Fprintln(c, `[error] failed to encode stats`)
+				continue
+			}
+			fmt.Fprintln(c, string(b))
+			continue
+		}
+
+		// ORDERV2 <json> -> like ORDER, but the ack is a single-line JSON object
+		if raw, ok := strings.CutPrefix(line, "ORDERV2"); ok {
+			raw, ok := orderPayload(raw)
+			if !ok {
+				break
+			}
+			ack := placeOrder(raw)
+			ack.Nonce = orderNonce(raw)
+			b, err := json.Marshal(ack)
+			if err != nil {
+				fmt.Fprintln(c, `{"status":"error","message":"failed to encode ack"}`)
 				continue
 			}
+			fmt.Fprintln(c, string(b))
+			continue
+		}
 
-			total := float64(ord.Quantity) * chosen.Price
+		// ORDER <json> -> server validates and replies with a single-line ack
+		if raw, ok := strings.CutPrefix(line, "ORDER"); ok {
+			raw, ok := orderPayload(raw)
+			if !ok {
+				break
+			}
+			ack := placeOrder(raw)
+			if ack.Status != ackOK {
+				fmt.Fprintf(c, "[error] %s\n", ack.Message)
+				continue
+			}
+			fmt.Fprintf(c, "OK|%.2f|%s\n", ack.Total, ack.OrderID)
+			continue
+		}
 
-			h.msgCh <- broadcast{
-				text: fmt.Sprintf("[order] %s ordered %d × %s ($%.2f)", ord.Name, ord.Quantity, chosen.Name, total),
+		// STATUS <orderId> <state> -> privileged; advances an order and broadcasts it
+		if rest, ok := strings.CutPrefix(line, "STATUS "); ok {
+			if !admin {
+				fmt.Fprintln(c, "[error] not authorized")
+				continue
+			}
+			orderID, state, _ := strings.Cut(strings.TrimSpace(rest), " ")
+			state = strings.ToLower(strings.TrimSpace(state))
+			if reject := h.status.advance(orderID, state, time.Now()); reject != "" {
+				fmt.Fprintf(c, "[error] %s\n", reject)
+				continue
 			}
+			logInfof("status: order=%s state=%s by user=%s id=%s", orderID, state, username, id)
+			h.msgCh <- broadcast{text: stamped("status", orderID+" "+state)}
+			continue
+		}
 
-			fmt.Fprintf(c, "OK|%.2f\n", total)
+		// ADDITEM <json>, DELITEM <id>, SETPRICE <id> <price> -> privileged;
+		// change the live menu and tell clients to fetch it again
+		if rest, ok := strings.CutPrefix(line, "ADDITEM "); ok {
+			if !admin {
+				fmt.Fprintln(c, "[error] not authorized")
+				continue
+			}
+			raw := json.RawMessage(strings.TrimSpace(rest))
+			if !json.Valid(raw) {
+				fmt.Fprintln(c, "[error] invalid item: not JSON")
+				continue
+			}
+			if err := checkItemFields(raw); err != nil {
+				fmt.Fprintf(c, "[error] invalid item: %v\n", err)
+				continue
+			}
+			var it menuItem
+			if err := json.Unmarshal(raw, &it); err != nil {
+				fmt.Fprintf(c, "[error] invalid item: %v\n", err)
+				continue
+			}
+			if err := validateItem(it); err != nil {
+				fmt.Fprintf(c, "[error] invalid item: %v\n", err)
+				continue
+			}
+			if reject := h.menu.add(it); reject != "" {
+				fmt.Fprintf(c, "[error] %s\n", reject)
+				continue
+			}
+			logInfof("menu: added item=%s price=%.2f by user=%s id=%s", it.ID, it.Price, username, id)
+			h.msgCh <- broadcast{text: stamped("menu", "updated")}
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "DELITEM "); ok {
+			if !admin {
+				fmt.Fprintln(c, "[error] not authorized")
+				continue
+			}
+			itemID := strings.TrimSpace(rest)
+			if reject := h.menu.remove(itemID); reject != "" {
+				fmt.Fprintf(c, "[error] %s\n", reject)
+				continue
+			}
+			logInfof("menu: removed item=%s by user=%s id=%s", itemID, username, id)
+			h.msgCh <- broadcast{text: stamped("menu", "updated")}
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "SETPRICE "); ok {
+			if !admin {
+				fmt.Fprintln(c, "[error] not authorized")
+				continue
+			}
+			itemID, priceText, _ := strings.Cut(strings.TrimSpace(rest), " ")
+			price, err := strconv.ParseFloat(strings.TrimSpace(priceText), 64)
+			if err != nil || !(price >= 0) || math.IsInf(price, 0) {
+				fmt.Fprintln(c, "[error] invalid price")
+				continue
+			}
+			if reject := h.menu.setPrice(itemID, price); reject != "" {
+				fmt.Fprintf(c, "[error] %s\n", reject)
+				continue
+			}
+			logInfof("menu: item=%s price=%.2f by user=%s id=%s", itemID, price, username, id)
+			h.msgCh <- broadcast{text: stamped("menu", "updated")}
 			continue
 		}
 
@@ -218,6 +2155,97 @@ func handleConn(h *Hub, c net.Conn) {
 		if line == "/quit" {
 			break // unified leave handling below
 		}
+		if token, ok := strings.CutPrefix(line, "/admin "); ok {
+			if h.cfg.adminToken == "" || subtle.ConstantTimeCompare([]byte(token), []byte(h.cfg.adminToken)) != 1 {
+				fmt.Fprintln(c, "[error] not authorized")
+				continue
+			}
+			admin = true
+			fmt.Fprintln(c, "[info] admin commands enabled")
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "/kick "); ok {
+			if !admin {
+				fmt.Fprintln(c, "[error] not authorized")
+				continue
+			}
+			target := strings.TrimSpace(rest)
+			kickedID, kickedRoom, ok := h.kick(target)
+			if !ok {
+				fmt.Fprintln(c, "[error] no such user")
+				continue
+			}
+			logInfof("kick: user=%s id=%s by user=%s id=%s", target, kickedID, username, id)
+			// Like [leave], [kick] goes to the kicked user's room only.
+			h.msgCh <- broadcast{text: stamped("kick", fmt.Sprintf("%s (%s) was kicked by %s", target, kickedID, username)), room: kickedRoom}
+			if kickedRoom != room {
+				fmt.Fprintf(c, "[info] kicked %s from room %s\n", target, kickedRoom)
+			}
+			continue
+		}
+		if line == "/clear" {
+			if !admin {
+				fmt.Fprintln(c, "[error] not authorized")
+				continue
+			}
+			h.clearHistory()
+			logInfof("clear: history cleared by user=%s id=%s", username, id)
+			continue
+		}
+		if line == "/help" {
+			for _, l := range helpLines {
+				fmt.Fprintf(c, "[help] %s\n", l)
+			}
+			continue
+		}
+		if line == "/whoami" {
+			fmt.Fprintf(c, "[info] you are %s (%s)\n", username, id)
+			continue
+		}
+		if line == "/list" {
+			fmt.Fprintf(c, "[users] %s\n", strings.Join(h.usernames(room), ", "))
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "/msg "); ok {
+			to, text, _ := strings.Cut(strings.TrimSpace(rest), " ")
+			text, ok := h.chatText(c, text)
+			if !ok {
+				continue
+			}
+			if to == "" || text == "" {
+				fmt.Fprintln(c, "[error] usage: /msg <username> <text>")
+				continue
+			}
+			if !h.privateMessage(self, to, text) {
+				fmt.Fprintln(c, "[error] no such user")
+			}
+			continue
+		}
+		if action, ok := strings.CutPrefix(line, "/me "); ok {
+			action, ok := h.chatText(c, action)
+			if ok && action != "" {
+				h.tryBroadcast(broadcast{text: stamped("action", username+" "+action), room: room})
+			}
+			continue
+		}
+		if rest, ok := strings.CutPrefix(line, "/join "); ok {
+			next := sanitizeUsername(rest)
+			if next == "" {
+				fmt.Fprintln(c, "[error] invalid room name")
+				continue
+			}
+			if next == room {
+				fmt.Fprintf(c, "[info] already in room %s\n", room)
+				continue
+			}
+			h.msgCh <- broadcast{text: stamped("leave", fmt.Sprintf("%s (%s)", username, id)), exclude: c, room: room}
+			fmt.Fprintf(c, "[info] joined room %s\n", next)
+			h.moveRoom(self, next)
+			room = next
+			logInfof("room: user=%s id=%s room=%s", username, id, room)
+			h.msgCh <- broadcast{text: stamped("join", fmt.Sprintf("%s (%s)", username, id)), exclude: c, room: room}
+			continue
+		}
 		if desired, ok := strings.CutPrefix(line, "/name "); ok {
 			newName := sanitizeUsername(desired)
 			if newName == "" {
@@ -229,49 +2257,292 @@ func handleConn(h *Hub, c net.Conn) {
 				fmt.Fprintf(c, "[info] username unchanged: %s\n", username)
 				continue
 			}
+			if !h.setUsername(self, newName) {
+				fmt.Fprintln(c, "[error] username taken")
+				continue
+			}
 			old := username
 			username = newName
+			fmt.Fprintf(c, "[info] name set to %s\n", username)
 			// Broadcast rename to everyone (including the renamer)
-			log.Printf("rename: user=%s id=%s remote=%s", username, id, c.RemoteAddr())
-			h.msgCh <- broadcast{text: fmt.Sprintf("[rename] %s (%s) -> %s", old, id, username)}
+			logInfof("rename: user=%s id=%s remote=%s", username, id, c.RemoteAddr())
+			h.msgCh <- broadcast{text: stamped("rename", fmt.Sprintf("%s (%s) -> %s", old, id, username)), room: room}
 			continue
 		}
 
 		// Regular chat message
-		h.msgCh <- broadcast{text: fmt.Sprintf("%s (%s): %s", username, id, line)}
+		line, ok := h.chatText(c, line)
+		if !ok || line == "" {
+			continue
+		}
+		h.tryBroadcast(broadcast{text: fmt.Sprintf("%s (%s): %s", username, id, line), room: room})
 	}
 	if err := scanner.Err(); err != nil {
-		log.Printf("read err from %s (%s): %v", username, id, err)
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			logInfof("idle: user=%s id=%s remote=%s", username, id, c.RemoteAddr())
+			_ = c.SetWriteDeadline(time.Now().Add(writeTimeout))
+			fmt.Fprintln(c, "[info] disconnecting due to inactivity")
+		} else {
+			logErrorf("read err from %s (%s): %v", username, id, err)
+		}
 	}
 
 	// Single, consistent leave announcement
-	log.Printf("leave: user=%s id=%s remote=%s", username, id, c.RemoteAddr())
-	h.msgCh <- broadcast{text: fmt.Sprintf("[leave] %s (%s)", username, id)}
+	logInfof("leave: user=%s id=%s remote=%s", username, id, c.RemoteAddr())
+	if !self.kicked.Load() {
+		h.msgCh <- broadcast{text: stamped("leave", fmt.Sprintf("%s (%s)", username, id)), room: room}
+	}
 }
 
-// startTCPServer starts a TCP chat server and never returns unless an error occurs.
-func startTCPServer(addr string, menu []menuItem) error {
-	if len(menu) == 0 {
-		menu = defaultMenu
+// isHeartbeat reports whether line is a PING or PONG, which keep a
+// connection alive without counting as activity for idleTimeout.
+func isHeartbeat(line string) bool {
+	line = strings.TrimSpace(line)
+	return strings.EqualFold(line, "PONG") || line == "PING"
+}
+
+// defaultGreeting is the line sent after the welcome when no greeting is configured.
+const defaultGreeting = "Use /name <username> to set your username. Allowed: letters, digits, _ . - (spaces become _)"
+
+// defaultRoom is the room every connection starts in.
+const defaultRoom = "lobby"
+
+// shutdownGrace is how long the server waits for the shutdown notice to reach clients.
+const shutdownGrace = 500 * time.Millisecond
+
+// logLevel is the severity of a log message. Messages below minLogLevel are
+// dropped; startup and shutdown messages use log directly and always appear.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelError
+)
+
+var minLogLevel = levelDebug
+
+func logf(level logLevel, format string, args ...any) {
+	if level >= minLogLevel {
+		log.Printf(format, args...)
+	}
+}
+
+func logDebugf(format string, args ...any) { logf(levelDebug, format, args...) }
+func logInfof(format string, args ...any)  { logf(levelInfo, format, args...) }
+func logErrorf(format string, args ...any) { logf(levelError, format, args...) }
+
+// rotatingFile is an append-only log file that is renamed to path+".1" when
+// a write would grow it past maxSize. The mutex guards rotation; the log
+// package already serializes individual writes.
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	f       *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		_ = f.Close()
+		return err
+	}
+	r.f, r.size = f, st.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			return 0, fmt.Errorf("rotate log: %w", err)
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+func (r *rotatingFile) rotate() error {
+	if err := r.f.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(r.path, r.path+".1"); err != nil {
+		_ = r.open()
+		return err
+	}
+	return r.open()
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+// startWebSocketServer serves WebSocket connections on cfg.wsAddr at
+// cfg.wsPath. Each connection is adapted to a net.Conn whose byte stream is
+// the concatenated text frames, so the newline-delimited protocol and
+// handleConn work unchanged.
+func startWebSocketServer(cfg serverConfig, serve func(net.Conn)) (*http.Server, error) {
+	ln, err := net.Listen("tcp", cfg.wsAddr)
+	if err != nil {
+		return nil, fmt.Errorf("websocket listen: %w", err)
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc(cfg.wsPath, func(w http.ResponseWriter, r *http.Request) {
+		wc, err := websocket.Accept(w, r, &websocket.AcceptOptions{OriginPatterns: cfg.wsOrigins})
+		if err != nil {
+			logErrorf("websocket accept from %s: %v", r.RemoteAddr, err)
+			return
+		}
+		serve(websocket.NetConn(context.Background(), wc, websocket.MessageText))
+	})
+	srv := &http.Server{Handler: mux, TLSConfig: cfg.tls}
+	go func() {
+		var err error
+		if cfg.tls != nil {
+			err = srv.ServeTLS(ln, "", "")
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logErrorf("websocket server: %v", err)
+		}
+	}()
+	log.Printf("WebSocket server listening on %s%s (tls=%t)", ln.Addr(), cfg.wsPath, cfg.tls != nil)
+	return srv, nil
+}
+
+// startTCPServer starts a TCP chat server and runs until an error occurs or
+// the process receives SIGINT/SIGTERM, in which case it shuts down gracefully.
+func startTCPServer(addr string, cfg serverConfig) error {
+	if cfg.logFile != "" {
+		lf, err := openRotatingFile(cfg.logFile, cfg.logMaxSize)
+		if err != nil {
+			return fmt.Errorf("open log file: %w", err)
+		}
+		defer lf.Close()
+		log.SetOutput(lf)
+		defer log.SetOutput(os.Stderr)
+	}
+	if cfg.quiet {
+		minLogLevel = levelError
+		defer func() { minLogLevel = levelDebug }()
+	}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return RunServer(ctx, addr, cfg)
+}
+
+// RunServer serves until ctx is canceled, then notifies clients and returns nil.
+func RunServer(ctx context.Context, addr string, cfg serverConfig) error {
+	if len(cfg.menu) == 0 {
+		cfg.menu = defaultMenu
+	}
+
+	var store *orderStore
+	if cfg.dbPath != "" {
+		s, err := openOrderStore(cfg.dbPath)
+		if err != nil {
+			return fmt.Errorf("open db: %w", err)
+		}
+		defer s.Close()
+		store = s
 	}
-	serverMenu = menu
 
-	ln, err := net.Listen("tcp", addr)
+	var (
+		ln  net.Listener
+		err error
+	)
+	if cfg.tls != nil {
+		ln, err = tls.Listen("tcp", addr, cfg.tls)
+	} else {
+		ln, err = net.Listen("tcp", addr)
+	}
 	if err != nil {
 		return err
 	}
-	log.Printf("TCP chat server listening on %s", ln.Addr())
-	log.Printf("Menu items: %d", len(serverMenu))
+	log.Printf("TCP chat server listening on %s (tls=%t)", ln.Addr(), cfg.tls != nil)
+	log.Printf("Menu items: %d", len(cfg.menu))
 
-	hub := NewHub()
+	hub := NewHub(cfg)
+	hub.store = store
 	go hub.Run()
 
+	// sem holds one token per active connection when maxConns is set.
+	var sem chan struct{}
+	if cfg.maxConns > 0 {
+		sem = make(chan struct{}, cfg.maxConns)
+	}
+	// serve handles a connection until it ends, or turns it away if the
+	// server is full.
+	serve := func(c net.Conn) {
+		if sem != nil {
+			select {
+			case sem <- struct{}{}:
+				defer func() { <-sem }()
+			default:
+				logInfof("rejecting %s: server full", c.RemoteAddr())
+				_ = c.SetWriteDeadline(time.Now().Add(writeTimeout))
+				fmt.Fprintln(c, "[error] server full")
+				_ = c.Close()
+				return
+			}
+		}
+		handleConn(hub, c)
+	}
+
+	if cfg.wsAddr != "" {
+		ws, err := startWebSocketServer(cfg, serve)
+		if err != nil {
+			_ = ln.Close()
+			hub.Stop()
+			return err
+		}
+		defer ws.Close()
+	}
+
+	go func() {
+		<-ctx.Done()
+		_ = ln.Close()
+	}()
+
 	for {
 		c, err := ln.Accept()
 		if err != nil {
-			log.Printf("accept error: %v", err)
+			if ctx.Err() != nil {
+				break
+			}
+			logErrorf("accept error: %v", err)
 			continue
 		}
-		go handleConn(hub, c)
+		go func() {
+			if c, probed := answerHealth(c); !probed {
+				serve(c)
+			}
+		}()
 	}
+
+	log.Printf("shutting down")
+	hub.msgCh <- broadcast{text: stamped("server", "shutting down")}
+	time.Sleep(shutdownGrace)
+	hub.Stop()
+	return nil
 }
@@ -0,0 +1,1154 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// testMenu is a small menu for server tests; "tea" has limited stock.
+func testMenu() []menuItem {
+	stock := 2.0
+	return []menuItem{
+		{ID: "latte", Name: "Latte", Price: 4.5},
+		{ID: "tea", Name: "Tea", Price: 3, Stock: &stock},
+		{ID: "apples", Name: "Apples", Price: 3.2, Unit: "kg"},
+	}
+}
+
+// testServerConfig is the server configuration the flags default to, with
+// the rate limit and heartbeat left off.
+func testServerConfig() serverConfig {
+	return serverConfig{
+		menu:            testMenu(),
+		historySize:     20,
+		replaySize:      256,
+		broadcastBuffer: 128,
+		adminToken:      "secret",
+	}
+}
+
+// freeAddr returns a loopback address nothing is listening on.
+func freeAddr(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	_ = ln.Close()
+	return addr
+}
+
+// runTestServer runs RunServer on addr until stop is called, which waits for
+// it to return.
+func runTestServer(t *testing.T, addr string, cfg serverConfig) (stop func()) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() { done <- RunServer(ctx, addr, cfg) }()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		c, err := net.Dial("tcp", addr)
+		if err == nil {
+			_ = c.Close()
+			break
+		}
+		if time.Now().After(deadline) {
+			cancel()
+			t.Fatalf("server did not start: %v", err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	stopped := false
+	stop = func() {
+		if stopped {
+			return
+		}
+		stopped = true
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("RunServer: %v", err)
+		}
+	}
+	t.Cleanup(stop)
+	return stop
+}
+
+// startServer runs a server with cfg for the rest of the test.
+func startServer(t *testing.T, cfg serverConfig) string {
+	t.Helper()
+	addr := freeAddr(t)
+	runTestServer(t, addr, cfg)
+	return addr
+}
+
+// dialHub runs a hub with cfg and serves one in-memory connection to it,
+// without RunServer's defaults.
+func dialHub(t *testing.T, cfg serverConfig) *testConn {
+	t.Helper()
+	h := NewHub(cfg)
+	go h.Run()
+	t.Cleanup(h.Stop)
+	c, s := net.Pipe()
+	go handleConn(h, s)
+	t.Cleanup(func() { _ = c.Close() })
+	tc := &testConn{t: t, c: c, r: bufio.NewReader(c)}
+	tc.line()
+	tc.line()
+	return tc
+}
+
+// testConn is a raw protocol client.
+type testConn struct {
+	t  *testing.T
+	c  net.Conn
+	r  *bufio.Reader
+	id string
+}
+
+// dial connects to addr and reads the two greeting lines.
+func dial(t *testing.T, addr string) *testConn {
+	t.Helper()
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = c.Close() })
+	tc := &testConn{t: t, c: c, r: bufio.NewReader(c)}
+	welcome := tc.line()
+	if _, rest, ok := strings.Cut(welcome, "("); ok {
+		tc.id, _, _ = strings.Cut(rest, ")")
+	}
+	tc.line()
+	return tc
+}
+
+func (tc *testConn) send(format string, args ...any) {
+	tc.t.Helper()
+	if _, err := fmt.Fprintf(tc.c, format+"\n", args...); err != nil {
+		tc.t.Fatal(err)
+	}
+}
+
+// line reads the next line, failing the test after 2s.
+func (tc *testConn) line() string {
+	tc.t.Helper()
+	_ = tc.c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	l, err := tc.r.ReadString('\n')
+	if err != nil {
+		tc.t.Fatalf("read: %v (got %q)", err, l)
+	}
+	return strings.TrimRight(l, "\r\n")
+}
+
+// until reads lines until one satisfies ok and returns it.
+func (tc *testConn) until(ok func(string) bool) string {
+	tc.t.Helper()
+	for {
+		if l := tc.line(); ok(l) {
+			return l
+		}
+	}
+}
+
+// expect reads lines until one contains want.
+func (tc *testConn) expect(want string) string {
+	tc.t.Helper()
+	return tc.until(func(l string) bool { return strings.Contains(l, want) })
+}
+
+// quiet fails the test if a line containing unwanted arrives within d.
+func (tc *testConn) quiet(unwanted string, d time.Duration) {
+	tc.t.Helper()
+	_ = tc.c.SetReadDeadline(time.Now().Add(d))
+	for {
+		l, err := tc.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		if strings.Contains(l, unwanted) {
+			tc.t.Fatalf("got %q", strings.TrimSpace(l))
+		}
+	}
+}
+
+// closed reports whether the server closed the connection within 2s,
+// skipping any lines still on the way.
+func (tc *testConn) closed() bool {
+	_ = tc.c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	for {
+		if _, err := tc.r.ReadString('\n'); err != nil {
+			return err == io.EOF || strings.Contains(err.Error(), "reset")
+		}
+	}
+}
+
+// admin unlocks the admin commands with testServerConfig's token.
+func (tc *testConn) admin() {
+	tc.t.Helper()
+	tc.send("/admin secret")
+	tc.expect("[info] admin commands enabled")
+}
+
+func TestReplaySinceReturnsLaterBroadcastsInOrder(t *testing.T) {
+	h := NewHub(testServerConfig())
+	go h.Run()
+	defer h.Stop()
+
+	const n = 10
+	for i := 1; i <= n; i++ {
+		h.msgCh <- broadcast{text: fmt.Sprintf("line %d", i)}
+	}
+	waitFor(t, func() bool {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		return h.seq == n
+	})
+
+	for _, k := range []uint64{0, 3, 9, 10} {
+		lines, latest := h.replaySince(defaultRoom, k)
+		if latest != n {
+			t.Errorf("REPLAY %d: latest = %d, want %d", k, latest, n)
+		}
+		if len(lines) != n-int(k) {
+			t.Fatalf("REPLAY %d: got %d lines, want %d: %q", k, len(lines), n-int(k), lines)
+		}
+		for i, l := range lines {
+			seq := k + uint64(i) + 1
+			if want := fmt.Sprintf("#%d line %d", seq, seq); l != want {
+				t.Errorf("REPLAY %d: line %d = %q, want %q", k, i, l, want)
+			}
+		}
+	}
+}
+
+func TestReplayCommand(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	var seqs []uint64
+	for i := 1; i <= 5; i++ {
+		a.send("msg %d", i)
+		seq, _ := splitSeq(a.expect(fmt.Sprintf(": msg %d", i)))
+		seqs = append(seqs, seq)
+	}
+
+	a.send("REPLAY %d", seqs[1])
+	for i := 3; i <= 5; i++ {
+		l := a.line()
+		if seq, rest := splitSeq(l); seq != seqs[i-1] || !strings.HasSuffix(rest, fmt.Sprintf(": msg %d", i)) {
+			t.Fatalf("replayed %q, want #%d with msg %d", l, seqs[i-1], i)
+		}
+	}
+	if got, want := a.line(), fmt.Sprintf("[info] replayed 3, latest #%d", seqs[4]); got != want {
+		t.Fatalf("got %q, want %q", got, want)
+	}
+}
+
+func TestReplayDetectsServerRestart(t *testing.T) {
+	addr := freeAddr(t)
+	stop := runTestServer(t, addr, testServerConfig())
+	a := dial(t, addr)
+	var last uint64
+	for i := 1; i <= 5; i++ {
+		a.send("msg %d", i)
+		last, _ = splitSeq(a.expect(fmt.Sprintf(": msg %d", i)))
+	}
+
+	// A server still running is not taken for a restarted one.
+	msg := connectCmd(addr, nil, "", last, time.Second)()
+	connected, ok := msg.(connectedMsg)
+	if !ok {
+		t.Fatalf("connect: %v", msg)
+	}
+	_ = connected.conn.Close()
+	if connected.restarted {
+		t.Fatal("restarted before the server restarted")
+	}
+
+	stop()
+	runTestServer(t, addr, testServerConfig())
+	msg = connectCmd(addr, nil, "", last, time.Second)()
+	connected, ok = msg.(connectedMsg)
+	if !ok {
+		t.Fatalf("reconnect: %v", msg)
+	}
+	defer connected.conn.Close()
+	if !connected.restarted {
+		t.Fatal("restart not detected")
+	}
+
+	// The client forgets the old number, so the new server's broadcasts
+	// are shown instead of skipped as already seen.
+	m := newTestModel()
+	m.lastSeq = last
+	updated, _ := m.Update(connected)
+	m = updated.(model)
+	if m.lastSeq >= last {
+		t.Fatalf("lastSeq = %d after restart, want it reset below %d", m.lastSeq, last)
+	}
+	m.applyBroadcasts([]string{fmt.Sprintf("#%d [order]|2026-10-15T08:00:00Z|ann ordered 1 × Latte ($4.50)", m.lastSeq+1)})
+	if got := m.broadcasts.items(); len(got) != 1 || !strings.Contains(got[0].text, "ann ordered") {
+		t.Fatalf("order after restart not shown: %+v", got)
+	}
+}
+
+// waitFor polls cond until it holds, failing the test after 2s.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 2s")
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// orderV2 places ord over tc with ORDERV2 and returns the ack.
+func (tc *testConn) orderV2(ord order) orderAck {
+	tc.t.Helper()
+	raw, err := json.Marshal(ord)
+	if err != nil {
+		tc.t.Fatal(err)
+	}
+	tc.send("ORDERV2 %s", raw)
+	var ack orderAck
+	l := tc.expect(`{"status"`)
+	if err := json.Unmarshal([]byte(l), &ack); err != nil {
+		tc.t.Fatalf("ack %q: %v", l, err)
+	}
+	return ack
+}
+
+// rename sets tc's username, retrying while a closed connection still holds it.
+func (tc *testConn) rename(name string) {
+	tc.t.Helper()
+	for deadline := time.Now().Add(2 * time.Second); ; {
+		tc.send("/name %s", name)
+		l := tc.until(func(l string) bool { return strings.HasPrefix(l, "[info] name set") || l == "[error] username taken" })
+		if strings.HasPrefix(l, "[info]") {
+			return
+		}
+		if time.Now().After(deadline) {
+			tc.t.Fatalf("username %s stayed taken", name)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNonceClaimIsAtomic(t *testing.T) {
+	var nc nonceCache
+	key := nonceKey("ann", "n1")
+	var owners atomic.Int32
+	acks := make(chan orderAck, 20)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(acks); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			e, owner := nc.claim(key, time.Now())
+			if owner {
+				owners.Add(1)
+				time.Sleep(10 * time.Millisecond)
+				nc.finish(key, e, orderAck{Status: ackOK, OrderID: "o1"})
+			}
+			<-e.done
+			acks <- e.ack
+		}()
+	}
+	wg.Wait()
+	close(acks)
+	if n := owners.Load(); n != 1 {
+		t.Fatalf("%d submissions placed the order, want 1", n)
+	}
+	for ack := range acks {
+		if ack.OrderID != "o1" {
+			t.Fatalf("duplicate got %+v", ack)
+		}
+	}
+}
+
+func TestDuplicateSubmitIsPlacedOnce(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	ord := order{Name: "ann", ItemID: "tea", Quantity: 1, Nonce: "n1"}
+
+	a := dial(t, addr)
+	a.rename("ann")
+	first := a.orderV2(ord)
+	if first.Status != ackOK {
+		t.Fatalf("first submit: %+v", first)
+	}
+	if again := a.orderV2(ord); again != first {
+		t.Fatalf("resubmit on the same connection: got %+v, want %+v", again, first)
+	}
+
+	// After a reconnect under the same name, the order is still recognized.
+	_ = a.c.Close()
+	b := dial(t, addr)
+	b.rename("ann")
+	if again := b.orderV2(ord); again != first {
+		t.Fatalf("resubmit after reconnect: got %+v, want %+v", again, first)
+	}
+
+	// Another user's nonce is their own, even if it is the same one.
+	c := dial(t, addr)
+	c.rename("bob")
+	other := c.orderV2(order{Name: "bob", ItemID: "tea", Quantity: 1, Nonce: "n1"})
+	if other.Status != ackOK || other.OrderID == first.OrderID {
+		t.Fatalf("bob's order: %+v, ann's was %+v", other, first)
+	}
+
+	// Tea started with 2 in stock; only the two distinct orders took any.
+	if ack := c.orderV2(order{Name: "bob", ItemID: "tea", Quantity: 1}); ack.Status == ackOK {
+		t.Fatalf("third tea accepted: %+v", ack)
+	}
+}
+
+func TestHealth(t *testing.T) {
+	cfg := testServerConfig()
+	cfg.maxConns = 1
+	addr := startServer(t, cfg)
+	a := dial(t, addr)
+
+	// A probe is answered with nothing but OK, even with the server full,
+	// and nobody sees it come and go.
+	c, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := io.WriteString(c, "HEALTH\n"); err != nil {
+		t.Fatal(err)
+	}
+	_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	if got, err := io.ReadAll(c); err != nil || string(got) != "OK\n" {
+		t.Fatalf("probe got %q, %v; want only OK", got, err)
+	}
+	a.quiet("[join]", 200*time.Millisecond)
+
+	// Sent later on, it is answered like any other command.
+	a.send("HEALTH")
+	a.until(func(l string) bool { return l == "OK" })
+}
+
+func TestKick(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	ann := dial(t, addr)
+	ann.rename("ann")
+	bob := dial(t, addr)
+	bob.rename("bob")
+
+	bob.send("/kick ann")
+	bob.expect("[error] not authorized")
+
+	bob.admin()
+	bob.send("/kick nobody")
+	bob.expect("[error] no such user")
+
+	bob.send("/kick ann")
+	bob.expect("[kick]")
+	ann.expect("[info] you were kicked")
+	if !ann.closed() {
+		t.Fatal("kicked connection still open")
+	}
+	bob.send("/list")
+	if l := bob.expect("[users]"); strings.Contains(l, "ann") {
+		t.Fatalf("ann still listed: %q", l)
+	}
+}
+
+func TestIdleTimeoutIgnoresHeartbeats(t *testing.T) {
+	cfg := testServerConfig()
+	cfg.idleTimeout = 300 * time.Millisecond
+	addr := startServer(t, cfg)
+	a := dial(t, addr)
+
+	// Chat keeps the connection open past the timeout.
+	for i := 0; i < 3; i++ {
+		time.Sleep(150 * time.Millisecond)
+		a.send("still here")
+	}
+	a.expect(": still here")
+
+	// Heartbeats alone do not.
+	start := time.Now()
+	go func() {
+		for i := 0; i < 10; i++ {
+			time.Sleep(50 * time.Millisecond)
+			if _, err := fmt.Fprintln(a.c, "PONG"); err != nil {
+				return
+			}
+			_, _ = fmt.Fprintln(a.c, "PING")
+		}
+	}()
+	a.expect("[info] disconnecting due to inactivity")
+	if waited := time.Since(start); waited > time.Second {
+		t.Fatalf("disconnected after %v, want about %v", waited, cfg.idleTimeout)
+	}
+	if !a.closed() {
+		t.Fatal("idle connection still open")
+	}
+}
+
+func TestLoadMenuRejectsMalformedFiles(t *testing.T) {
+	for _, tc := range []struct {
+		name, menu, want string
+	}{
+		{"not an array", `{"id":"latte"}`, "want an array of items, got object"},
+		{"broken JSON", `[{"id":"latte",`, "parse menu JSON"},
+		{"missing price", `[{"id":"latte","name":"Latte"}]`, `menu item 0 (latte): missing "price"`},
+		{"mistyped price", `[{"id":"latte","name":"Latte","price":"4.50"}]`, `menu item 0 (latte): "price" must be a number, got string`},
+		{"missing id", `[{"name":"Latte","price":4.5}]`, `menu item 0: missing "id"`},
+		{"negative price", `[{"id":"latte","name":"Latte","price":-1}]`, "menu item 0 (latte): negative price"},
+		{"duplicate id", `[{"id":"latte","name":"Latte","price":4.5},{"id":"LATTE","name":"Latte","price":5}]`, `menu item 1: duplicate id "LATTE" (also item 0)`},
+		{"modifier without choices", `[{"id":"latte","name":"Latte","price":4.5,"modifiers":[{"name":"Size"}]}]`, `menu item 0 (latte): modifier 0: missing "choices"`},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "menu.json")
+			if err := os.WriteFile(path, []byte(tc.menu), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			_, err := loadMenu(path)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("loadMenu: %v, want an error containing %q", err, tc.want)
+			}
+		})
+	}
+}
+
+func TestFreeItems(t *testing.T) {
+	menu, err := loadMenu(`[{"id":"water","name":"Water","price":0}]`)
+	if err != nil || len(menu) != 1 || menu[0].Price != 0 {
+		t.Fatalf("free item: %v, %+v", err, menu)
+	}
+
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	a.admin()
+	a.send(`ADDITEM {"id":"napkin","name":"Napkin","price":0}`)
+	a.expect("[menu]")
+	a.send("SETPRICE latte 0")
+	a.expect("[menu]")
+	a.send("SETPRICE latte -1")
+	a.expect("[error] invalid price")
+	a.send(`ADDITEM {"id":"cup","name":"Cup"}`)
+	a.expect(`[error] invalid item: missing "price"`)
+
+	a.send("ITEM latte")
+	var latte menuItem
+	if err := json.Unmarshal([]byte(a.expect(`"id":"latte"`)), &latte); err != nil || latte.Price != 0 {
+		t.Fatalf("latte after SETPRICE 0: %v, %+v", err, latte)
+	}
+	if ack := a.orderV2(order{Name: "ann", Items: []orderLine{{ItemID: "latte", Quantity: 2}, {ItemID: "napkin", Quantity: 1}}}); ack.Status != ackOK || ack.Total != 0 {
+		t.Fatalf("free order: %+v", ack)
+	}
+}
+
+func TestFractionalQuantities(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	ack := a.orderV2(order{Name: "ann", Items: []orderLine{{ItemID: "apples", Quantity: 0.75}, {ItemID: "latte", Quantity: 1}}})
+	if ack.Status != ackOK || ack.Total != 6.9 {
+		t.Fatalf("0.75 kg apples and a latte: %+v, want a total of 6.90", ack)
+	}
+	if ack := a.orderV2(order{Name: "ann", ItemID: "latte", Quantity: 1.5}); ack.Message != "invalid quantity" {
+		t.Fatalf("1.5 lattes: %+v", ack)
+	}
+}
+
+// join moves tc to room.
+func (tc *testConn) join(room string) {
+	tc.t.Helper()
+	tc.send("/join %s", room)
+	tc.expect("[info] joined room " + room)
+}
+
+func TestRoomsIsolateBroadcasts(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	ann := dial(t, addr)
+	ann.rename("ann")
+	ann.admin()
+	bob := dial(t, addr)
+	bob.rename("bob")
+	bob.join("kitchen")
+	carl := dial(t, addr)
+	carl.rename("carl")
+	carl.join("kitchen")
+
+	bob.send("hi kitchen")
+	carl.expect("bob (" + bob.id + "): hi kitchen")
+	ann.quiet("hi kitchen", 200*time.Millisecond)
+
+	if ack := bob.orderV2(order{Name: "bob", ItemID: "latte", Quantity: 1}); ack.Status != ackOK {
+		t.Fatalf("kitchen order: %+v", ack)
+	}
+	carl.expect("[order]")
+	if ack := ann.orderV2(order{Name: "ann", ItemID: "latte", Quantity: 2}); ack.Status != ackOK {
+		t.Fatalf("lobby order: %+v", ack)
+	}
+	bob.quiet("ann ordered", 200*time.Millisecond)
+
+	// Joining replays that room's orders only.
+	dave := dial(t, addr)
+	dave.send("/join kitchen")
+	dave.expect("bob ordered")
+	dave.quiet("ann ordered", 200*time.Millisecond)
+
+	ann.send("/kick carl")
+	ann.expect("[info] kicked carl from room kitchen")
+	bob.expect("[kick]")
+	ann.quiet("[kick]", 200*time.Millisecond)
+}
+
+func TestMoveRoomEvictsClientWithoutRoomForHistory(t *testing.T) {
+	h := NewHub(testServerConfig())
+	conn, other := net.Pipe()
+	defer other.Close()
+	cl := &client{conn: conn, id: "c1", username: "ann", room: defaultRoom, out: make(chan string, 1)}
+	h.conns[conn] = cl
+	h.connected.Add(1)
+	for i := 0; i < 3; i++ {
+		h.historyLocked("kitchen").push(fmt.Sprintf("#%d [order]|x|order %d", i+1, i+1))
+	}
+
+	h.moveRoom(cl, "kitchen")
+	if _, ok := h.conns[conn]; ok {
+		t.Fatal("client kept despite missing part of the room's history")
+	}
+}
+
+func TestShutdownNotifiesClients(t *testing.T) {
+	addr := freeAddr(t)
+	stop := runTestServer(t, addr, testServerConfig())
+	a := dial(t, addr)
+	go stop()
+	if _, rest := splitSeq(a.expect("[server]")); !strings.HasSuffix(rest, "|shutting down") {
+		t.Fatalf("got %q, want the shutdown notice", rest)
+	}
+	if !a.closed() {
+		t.Fatal("connection still open after shutdown")
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	r := &rateLimiter{limit: 2, window: 10 * time.Second}
+	start := time.Now()
+	for i := range 2 {
+		if ok, _ := r.allow(start.Add(time.Duration(i) * time.Second)); !ok {
+			t.Fatalf("event %d refused", i)
+		}
+	}
+	ok, wait := r.allow(start.Add(3 * time.Second))
+	if ok || wait != 7*time.Second {
+		t.Fatalf("third event: %v, wait %v; want refused for 7s", ok, wait)
+	}
+	if ok, _ := r.allow(start.Add(10*time.Second + time.Millisecond)); !ok {
+		t.Fatal("event after the first left the window refused")
+	}
+}
+
+func TestOrdersAreRateLimited(t *testing.T) {
+	cfg := testServerConfig()
+	cfg.orderLimit, cfg.orderWindow = 2, 10*time.Second
+	addr := startServer(t, cfg)
+	a := dial(t, addr)
+	watcher := dial(t, addr)
+	for i := range 2 {
+		if ack := a.orderV2(order{Name: "ann", ItemID: "latte", Quantity: 1}); ack.Status != ackOK {
+			t.Fatalf("order %d: %+v", i, ack)
+		}
+	}
+	ack := a.orderV2(order{Name: "ann", ItemID: "latte", Quantity: 3})
+	if ack.Status != ackError || !strings.HasPrefix(ack.Message, "rate limited, try again in ") {
+		t.Fatalf("third order: %+v", ack)
+	}
+	a.send(`ORDER {"name":"ann","itemId":"latte","quantity":3}`)
+	if l := a.expect("[error]"); !strings.HasPrefix(l, "[error] rate limited, try again in ") || !strings.HasSuffix(l, "s") {
+		t.Fatalf("ORDER over the limit: %q", l)
+	}
+	watcher.expect("[order]")
+	watcher.expect("[order]")
+	watcher.quiet("3 × ", 200*time.Millisecond)
+}
+
+func TestPrivateMessage(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	ann := dial(t, addr)
+	ann.rename("ann")
+	bob := dial(t, addr)
+	bob.rename("bob")
+	carl := dial(t, addr)
+	carl.rename("carl")
+
+	ann.send("/msg bob hi there")
+	want := "[pm] ann -> bob: hi there"
+	if l := bob.expect("[pm]"); l != want {
+		t.Fatalf("bob got %q, want %q", l, want)
+	}
+	if l := ann.expect("[pm]"); l != want {
+		t.Fatalf("ann got %q, want %q", l, want)
+	}
+	bob.send("/msg ann hello back")
+	ann.expect("[pm] bob -> ann: hello back")
+	carl.quiet("[pm]", 200*time.Millisecond)
+
+	ann.send("/msg nobody hi")
+	ann.expect("[error] no such user")
+}
+
+func TestMaxConns(t *testing.T) {
+	cfg := testServerConfig()
+	cfg.maxConns = 2
+	addr := startServer(t, cfg)
+	// first dials addr and returns the connection and its first line.
+	first := func() (net.Conn, string) {
+		c, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { _ = c.Close() })
+		_ = c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		l, err := bufio.NewReader(c).ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		return c, strings.TrimSpace(l)
+	}
+	// welcome dials until a slot is free, e.g. once startServer's probe
+	// or a closed connection has left.
+	welcome := func() net.Conn {
+		for deadline := time.Now().Add(2 * time.Second); ; {
+			c, l := first()
+			if strings.HasPrefix(l, "Welcome") {
+				return c
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("no free slot: %q", l)
+			}
+			time.Sleep(20 * time.Millisecond)
+		}
+	}
+
+	a := welcome()
+	welcome()
+	if _, l := first(); l != "[error] server full" {
+		t.Fatalf("third connection got %q", l)
+	}
+	_ = a.Close()
+	welcome()
+}
+
+func TestItemIDsMatchIgnoringCase(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	for _, ord := range []order{
+		{Name: "ann", ItemID: "LATTE", Quantity: 1},
+		{Name: "ann", Items: []orderLine{{ItemID: "Latte", Quantity: 1}, {ItemID: "aPPles", Quantity: 0.5}}},
+	} {
+		if ack := a.orderV2(ord); ack.Status != ackOK {
+			t.Fatalf("%+v: %+v", ord, ack)
+		}
+		// The broadcast uses the menu's name, not the ID as sent.
+		if l := a.expect("[order]"); !strings.Contains(l, "× Latte") {
+			t.Fatalf("broadcast %q does not name the Latte", l)
+		}
+	}
+
+	a.send("ITEM LaTTe")
+	var it menuItem
+	if err := json.Unmarshal([]byte(a.expect(`{"id"`)), &it); err != nil || it.ID != "latte" || it.Name != "Latte" {
+		t.Fatalf("ITEM LaTTe: %v, %+v", err, it)
+	}
+	if ack := a.orderV2(order{Name: "ann", ItemID: "mocha", Quantity: 1}); ack.Message != "unknown item" {
+		t.Fatalf("unknown item: %+v", ack)
+	}
+}
+
+func TestOneAckPerOrder(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	// Sent in one write: accepted, rejected and malformed orders, then PING.
+	a.send("ORDER {\"name\":\"ann\",\"itemId\":\"latte\",\"quantity\":1}\nORDER {\"name\":\"ann\",\"itemId\":\"mocha\",\"quantity\":1}\nORDER {\nPING")
+	var replies []string
+	for {
+		l := a.line()
+		if seq, _ := splitSeq(l); seq > 0 {
+			continue
+		}
+		if l == "PONG" {
+			break
+		}
+		replies = append(replies, l)
+	}
+	if len(replies) != 3 || !strings.HasPrefix(replies[0], "OK|4.50|") || replies[1] != "[error] unknown item" || replies[2] != "[error] invalid order json" {
+		t.Fatalf("replies: %q", replies)
+	}
+}
+
+func TestSanitizeChat(t *testing.T) {
+	for in, want := range map[string]string{
+		"hello":                  "hello",
+		"  padded\t":             "padded",
+		"tab\tstop":              "tab stop",
+		"bell\a and \x1b[31mred": "bell and [31mred",
+		"nul\x00byte\x7f":        "nulbyte",
+		"zero\u200bwidth":        "zerowidth",
+		"café ☕":                 "café ☕",
+		"\x01\x02":               "",
+	} {
+		if got := sanitizeChat(in); got != want {
+			t.Errorf("sanitizeChat(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestChatLimits(t *testing.T) {
+	cfg := testServerConfig()
+	cfg.maxChat = 10
+	addr := startServer(t, cfg)
+	a := dial(t, addr)
+	b := dial(t, addr)
+
+	a.send("this is far too long")
+	a.expect("[error] message too long (max 10 characters)")
+	// The limit counts characters, not bytes.
+	a.send("éééééééééé")
+	b.expect(": éééééééééé")
+	a.send("a\x07b\x1bc")
+	if l := b.expect("(" + a.id + "): "); !strings.HasSuffix(l, ": abc") {
+		t.Fatalf("control characters not stripped: %q", l)
+	}
+	a.send("/msg nobody this is far too long")
+	a.expect("[error] message too long")
+	b.quiet("far too long", 200*time.Millisecond)
+}
+
+func TestMaxQuantity(t *testing.T) {
+	cfg := testServerConfig()
+	cfg.maxQuantity = 99
+	addr := startServer(t, cfg)
+	a := dial(t, addr)
+	if ack := a.orderV2(order{Name: "ann", ItemID: "latte", Quantity: 99}); ack.Status != ackOK {
+		t.Fatalf("99 lattes: %+v", ack)
+	}
+	for _, ord := range []order{
+		{Name: "ann", ItemID: "latte", Quantity: 100},
+		{Name: "ann", Items: []orderLine{{ItemID: "latte", Quantity: 1}, {ItemID: "apples", Quantity: 99.5}}},
+	} {
+		if ack := a.orderV2(ord); ack.Message != "quantity exceeds max" {
+			t.Fatalf("%+v: %+v", ord, ack)
+		}
+	}
+	a.send(`ORDER {"name":"ann","itemId":"latte","quantity":1000000}`)
+	a.until(func(l string) bool { return l == "[error] quantity exceeds max" })
+}
+
+func TestOrderPayloadOnItsOwnLine(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	payload := `{"name":"ann","itemId":"latte","quantity":1}`
+	// isAck matches ORDER's replies.
+	isAck := func(l string) bool { return strings.HasPrefix(l, "OK|") || strings.HasPrefix(l, "[error]") }
+
+	a.send("ORDER %s", payload)
+	if l := a.until(isAck); !strings.HasPrefix(l, "OK|4.50|") {
+		t.Fatalf("one-line ORDER: %q", l)
+	}
+	a.send("ORDER\n%s", payload)
+	if l := a.until(isAck); !strings.HasPrefix(l, "OK|4.50|") {
+		t.Fatalf("two-line ORDER: %q", l)
+	}
+	a.send("ORDERV2\n%s", payload)
+	var ack orderAck
+	if err := json.Unmarshal([]byte(a.expect(`{"status"`)), &ack); err != nil || ack.Status != ackOK || ack.Total != 4.5 {
+		t.Fatalf("two-line ORDERV2: %v, %+v", err, ack)
+	}
+	// The line after a bare ORDER is its payload, even if it is a command.
+	a.send("ORDER\nPING")
+	if l := a.until(isAck); l != "[error] invalid order json" {
+		t.Fatalf("ORDER with PING for a payload: %q", l)
+	}
+}
+
+func TestEmptyMenu(t *testing.T) {
+	if _, err := loadMenu("[]"); err == nil || !strings.Contains(err.Error(), "menu has no items") {
+		t.Fatalf("loadMenu([]): %v", err)
+	}
+
+	// RunServer falls back to the default menu, so serve a hub directly.
+	cfg := testServerConfig()
+	cfg.menu = nil
+	a := dialHub(t, cfg)
+	a.send("MENU")
+	a.until(func(l string) bool { return l == "[error] menu is empty" })
+}
+
+func TestItemCommand(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	// item fetches one item with ITEM.
+	item := func(id string) menuItem {
+		t.Helper()
+		a.send("ITEM %s", id)
+		var it menuItem
+		if err := json.Unmarshal([]byte(a.expect(`{"id"`)), &it); err != nil {
+			t.Fatal(err)
+		}
+		return it
+	}
+
+	if it := item("tea"); it.ID != "tea" || it.Name != "Tea" || it.Price != 3 || it.Stock == nil || *it.Stock != 2 {
+		t.Fatalf("ITEM tea: %+v", it)
+	}
+	if ack := a.orderV2(order{Name: "ann", ItemID: "tea", Quantity: 1}); ack.Status != ackOK {
+		t.Fatalf("order: %+v", ack)
+	}
+	if it := item("tea"); it.Stock == nil || *it.Stock != 1 {
+		t.Fatalf("ITEM tea after an order: %+v", it)
+	}
+	if it := item("apples"); it.Unit != "kg" || it.Stock != nil {
+		t.Fatalf("ITEM apples: %+v", it)
+	}
+	a.send("ITEM mocha")
+	a.until(func(l string) bool { return l == "[error] unknown item" })
+}
+
+func TestClearHistory(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	if ack := a.orderV2(order{Name: "ann", ItemID: "latte", Quantity: 1}); ack.Status != ackOK {
+		t.Fatalf("order: %+v", ack)
+	}
+	// A new connection gets the order replayed.
+	late := dial(t, addr)
+	late.expect("[order]")
+
+	a.send("/clear")
+	a.expect("[error] not authorized")
+	a.admin()
+	a.send("/clear")
+	if _, rest := splitSeq(late.expect("[server]")); !strings.HasSuffix(rest, "|feed cleared") {
+		t.Fatalf("got %q, want the feed cleared notice", rest)
+	}
+
+	// Now neither a new connection nor REPLAY gets it.
+	later := dial(t, addr)
+	later.send("REPLAY 0")
+	// Broadcasts since, like the notice itself, are still replayed.
+	l := later.until(func(l string) bool { return strings.HasPrefix(l, "[info] replayed") || strings.Contains(l, "[order]") })
+	if !strings.HasPrefix(l, "[info] replayed") {
+		t.Fatalf("after /clear: %q", l)
+	}
+}
+
+func TestCheckMenuFields(t *testing.T) {
+	for _, tc := range []struct {
+		menu, want string
+	}{
+		{`[{"id":5,"name":"Latte","price":4.5}]`, `menu item 0: "id" must be a string, got number`},
+		{`[{"id":"latte","name":"Latte","price":4.5},{"id":"tea","name":"Tea","price":3,"stock":"lots"}]`, `menu item 1 (tea): "stock" must be a number, got string`},
+		{`[{"id":"latte","name":null,"price":4.5}]`, `menu item 0 (latte): "name" must be a string, got null`},
+		{`[{"id":"latte","name":"Latte","price":4.5,"unit":1}]`, `menu item 0 (latte): "unit" must be a string, got number`},
+		{`[{"id":"latte","name":"Latte","price":4.5,"modifiers":{}}]`, `menu item 0 (latte): "modifiers" must be an array, got object`},
+		{`[{"id":"latte","name":"Latte","price":4.5,"modifiers":[{"name":"Size","choices":[{"name":"Large","price":"0.5"}]}]}]`, `menu item 0 (latte): modifier 0: choice 0: "price" must be a number, got string`},
+		{`["latte"]`, `menu item 0: want an object, got string`},
+	} {
+		err := checkMenuFields([]byte(tc.menu))
+		if err == nil || !strings.Contains(err.Error(), tc.want) {
+			t.Errorf("%s: %v, want an error containing %q", tc.menu, err, tc.want)
+		}
+	}
+	// Null stock means unlimited, and unknown fields are ignored.
+	if err := checkMenuFields([]byte(`[{"ID":"latte","Name":"Latte","price":4.5,"stock":null,"color":"brown"}]`)); err != nil {
+		t.Errorf("valid menu: %v", err)
+	}
+}
+
+func TestSanitizeUsername(t *testing.T) {
+	for in, want := range map[string]string{
+		"José":             "José",
+		"ann smith":        "ann_smith",
+		"Zoë-2.0":          "Zoë-2.0",
+		"李小龍":              "李小龍",
+		"bob🎉":             "bob",
+		"🎉":                "",
+		"a/b\\c;d":         "abcd",
+		"ctrl\x07\x1bname": "ctrlname",
+		"__ann__":          "ann",
+		"ÅÅÅÅÅÅÅÅÅÅÅÅÅÅÅ":  "ÅÅÅÅÅÅÅÅÅÅÅÅ",
+		"١٢٣":              "١٢٣",
+	} {
+		if got := sanitizeUsername(in); got != want {
+			t.Errorf("sanitizeUsername(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestUnicodeUsername(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	a.send("/name José 🎉")
+	a.until(func(l string) bool { return l == "[info] name set to José" })
+	a.send("/whoami")
+	a.until(func(l string) bool { return l == "[info] you are José ("+a.id+")" })
+}
+
+// menuIDs fetches the menu over tc and returns its item IDs.
+func (tc *testConn) menuIDs() []string {
+	tc.t.Helper()
+	tc.send("MENU")
+	var items []menuItem
+	if err := json.Unmarshal([]byte(tc.expect(`[{"id"`)), &items); err != nil {
+		tc.t.Fatal(err)
+	}
+	var ids []string
+	for _, it := range items {
+		ids = append(ids, it.ID)
+	}
+	return ids
+}
+
+func TestMenuMutations(t *testing.T) {
+	addr := startServer(t, testServerConfig())
+	a := dial(t, addr)
+	watcher := dial(t, addr)
+
+	for _, cmd := range []string{`ADDITEM {"id":"mocha","name":"Mocha","price":5}`, "DELITEM latte", "SETPRICE latte 5"} {
+		a.send(cmd)
+		a.expect("[error] not authorized")
+	}
+	a.admin()
+
+	t.Run("ADDITEM", func(t *testing.T) {
+		a.send(`ADDITEM {"id":"mocha","name":"Mocha","price":5,"stock":3}`)
+		watcher.expect("[menu]")
+		if ids := a.menuIDs(); strings.Join(ids, ",") != "latte,tea,apples,mocha" {
+			t.Fatalf("menu after ADDITEM: %v", ids)
+		}
+		for cmd, want := range map[string]string{
+			`ADDITEM {"id":"MOCHA","name":"Mocha","price":5}`: "[error] duplicate id",
+			`ADDITEM mocha`: "[error] invalid item: not JSON",
+			`ADDITEM {"id":"x","name":"X","price":-1}`:  "[error] invalid item: negative price",
+			`ADDITEM {"id":"x","name":"X","price":"1"}`: `[error] invalid item: "price" must be a number, got string`,
+		} {
+			a.send("%s", cmd)
+			if l := a.expect("[error]"); l != want {
+				t.Errorf("%s: got %q, want %q", cmd, l, want)
+			}
+		}
+	})
+
+	t.Run("SETPRICE", func(t *testing.T) {
+		a.send("SETPRICE MOCHA 5.75")
+		watcher.expect("[menu]")
+		if ack := a.orderV2(order{Name: "ann", ItemID: "mocha", Quantity: 2}); ack.Total != 11.5 {
+			t.Fatalf("mocha at 5.75: %+v", ack)
+		}
+		for cmd, want := range map[string]string{
+			"SETPRICE nope 1":      "[error] unknown item",
+			"SETPRICE mocha cheap": "[error] invalid price",
+			"SETPRICE mocha -2":    "[error] invalid price",
+			"SETPRICE mocha Inf":   "[error] invalid price",
+		} {
+			a.send("%s", cmd)
+			if l := a.expect("[error]"); l != want {
+				t.Errorf("%s: got %q, want %q", cmd, l, want)
+			}
+		}
+		a.send("SETPRICE mocha 0")
+		watcher.expect("[menu]")
+	})
+
+	t.Run("DELITEM", func(t *testing.T) {
+		a.send("DELITEM Mocha")
+		watcher.expect("[menu]")
+		if ids := a.menuIDs(); strings.Join(ids, ",") != "latte,tea,apples" {
+			t.Fatalf("menu after DELITEM: %v", ids)
+		}
+		if ack := a.orderV2(order{Name: "ann", ItemID: "mocha", Quantity: 1}); ack.Message != "unknown item" {
+			t.Fatalf("order of a removed item: %+v", ack)
+		}
+		a.send("DELITEM mocha")
+		a.expect("[error] unknown item")
+		a.send("DELITEM tea")
+		a.send("DELITEM apples")
+		a.send("DELITEM latte")
+		a.expect("[error] cannot remove the last item")
+		if ids := a.menuIDs(); len(ids) != 1 || ids[0] != "latte" {
+			t.Fatalf("menu after removing all but one: %v", ids)
+		}
+	})
+}
+
+func TestHistoryListsOnlyOwnOrders(t *testing.T) {
+	for _, db := range []bool{false, true} {
+		cfg := testServerConfig()
+		if db {
+			cfg.dbPath = filepath.Join(t.TempDir(), "orders.db")
+		}
+		addr := startServer(t, cfg)
+		ann := dial(t, addr)
+		ann.rename("ann")
+		bob := dial(t, addr)
+		bob.rename("bob")
+		for _, ack := range []orderAck{
+			ann.orderV2(order{Name: "ann", ItemID: "latte", Quantity: 1}),
+			bob.orderV2(order{Name: "bob", ItemID: "latte", Quantity: 2}),
+		} {
+			if ack.Status != ackOK {
+				t.Fatalf("order: %+v", ack)
+			}
+		}
+
+		ann.send("HISTORY")
+		var orders []pastOrder
+		l := ann.until(func(l string) bool { return strings.HasPrefix(l, "[{") || l == "[]" })
+		if err := json.Unmarshal([]byte(l), &orders); err != nil {
+			t.Fatal(err)
+		}
+		if len(orders) != 1 || orders[0].Name != "ann" {
+			t.Fatalf("db %v: ann's history is %s", db, l)
+		}
+		ann.send("HISTORY bob")
+		ann.expect("[error] usage: HISTORY")
+	}
+}
+
+func TestStatusBoardForgetsStaleOrders(t *testing.T) {
+	b := newStatusBoard()
+	start := time.Now()
+	b.add("a1", start)
+	b.add("b2", start)
+	if reject := b.advance("a1", statePreparing, start.Add(time.Hour)); reject != "" {
+		t.Fatal(reject)
+	}
+	if reject := b.advance("b2", statePreparing, start.Add(statusTTL+time.Minute)); reject != "unknown order" {
+		t.Fatalf("stale order advanced: %q", reject)
+	}
+
+	// A new order sweeps out the ones nobody touched for statusTTL.
+	b.add("c3", start.Add(statusTTL+2*time.Hour))
+	if _, ok := b.states["a1"]; ok || len(b.states) != 1 {
+		t.Fatalf("board holds %v", b.states)
+	}
+	b.advance("c3", statePreparing, start.Add(statusTTL+2*time.Hour))
+	b.advance("c3", stateReady, start.Add(statusTTL+2*time.Hour))
+	if len(b.states) != 0 {
+		t.Fatalf("ready order kept: %v", b.states)
+	}
+}